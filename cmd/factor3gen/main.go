@@ -0,0 +1,111 @@
+// factor3gen generates a call to factor3.RegisterFieldDocs() for every struct in a Go file,
+// so the doc comments of the fields are used as the usage of their flags.
+//
+// Use it with go generate:
+//
+//	//go:generate go run github.com/drornir/factor3/cmd/factor3gen $GOFILE
+//
+// For config.go, it writes config_factor3.go next to it.
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"os"
+	"strings"
+)
+
+func main() {
+	files := os.Args[1:]
+	if len(files) == 0 {
+		if gofile := os.Getenv("GOFILE"); gofile != "" {
+			files = []string{gofile}
+		}
+	}
+	if len(files) == 0 {
+		fmt.Fprintln(os.Stderr, "usage: factor3gen file.go...")
+		os.Exit(2)
+	}
+
+	for _, file := range files {
+		if err := generate(file); err != nil {
+			fmt.Fprintf(os.Stderr, "factor3gen: %s: %s\n", file, err)
+			os.Exit(1)
+		}
+	}
+}
+
+type structDocs struct {
+	name   string
+	fields [][2]string
+}
+
+func generate(filename string) error {
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, filename, nil, parser.ParseComments)
+	if err != nil {
+		return err
+	}
+
+	var structs []structDocs
+	for _, decl := range f.Decls {
+		gen, ok := decl.(*ast.GenDecl)
+		if !ok || gen.Tok != token.TYPE {
+			continue
+		}
+		for _, spec := range gen.Specs {
+			ts := spec.(*ast.TypeSpec)
+			st, ok := ts.Type.(*ast.StructType)
+			if !ok || ts.TypeParams != nil {
+				continue
+			}
+			sd := structDocs{name: ts.Name.Name}
+			for _, field := range st.Fields.List {
+				doc := strings.Join(strings.Fields(field.Doc.Text()), " ")
+				if doc == "" {
+					continue
+				}
+				for _, name := range field.Names {
+					if name.IsExported() {
+						sd.fields = append(sd.fields, [2]string{name.Name, doc})
+					}
+				}
+			}
+			if len(sd.fields) > 0 {
+				structs = append(structs, sd)
+			}
+		}
+	}
+
+	out := strings.TrimSuffix(filename, ".go") + "_factor3.go"
+	if len(structs) == 0 {
+		if err := os.Remove(out); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "// Code generated by factor3gen. DO NOT EDIT.\n\n")
+	fmt.Fprintf(&b, "package %s\n\n", f.Name.Name)
+	fmt.Fprintf(&b, "import %q\n\n", "github.com/drornir/factor3/pkg/factor3")
+	fmt.Fprintf(&b, "func init() {\n")
+	for _, sd := range structs {
+		fmt.Fprintf(&b, "factor3.RegisterFieldDocs[%s](map[string]string{\n", sd.name)
+		for _, fd := range sd.fields {
+			fmt.Fprintf(&b, "%q: %q,\n", fd[0], fd[1])
+		}
+		fmt.Fprintf(&b, "})\n")
+	}
+	fmt.Fprintf(&b, "}\n")
+
+	src, err := format.Source(b.Bytes())
+	if err != nil {
+		return fmt.Errorf("formatting generated code: %w", err)
+	}
+	return os.WriteFile(out, src, 0o644)
+}
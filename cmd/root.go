@@ -23,7 +23,7 @@ var (
 	flagLogFormat  string
 	flagLogLevel   string
 
-	viperInstance = viper.New()
+	viperInstance = factor3.NewViper(viper.New())
 
 	globalConfig       example.Config
 	globalConfigLoader *factor3.Loader
@@ -57,6 +57,7 @@ func init() {
 	cobra.OnInitialize(initLogger)
 
 	// setup reading config file and
+	viperInstance.SetEnvPrefix(ProgramName)
 	l, err := factor3.Bind(&globalConfig, viperInstance, RootCmd.Flags())
 	if err != nil {
 		cobra.CheckErr(fmt.Errorf("config.Bind: %w", err))
@@ -70,6 +71,7 @@ func initViper() {
 		Viper:       viperInstance,
 		ProgramName: ProgramName,
 		CfgFile:     flagConfigFile,
+		Defaults:    example.Defaults,
 	}); err != nil {
 		cobra.CheckErr(fmt.Errorf("config.Initialize: %w", err))
 	}
@@ -8,23 +8,30 @@ import (
 )
 
 //go:generate easytags $GOFILE json:snake,yaml:snake
+//go:generate go run github.com/drornir/factor3/cmd/factor3gen $GOFILE
 
 type Config struct {
-	Version      string `json:"version" yaml:"version"`
-	Log          Log    `flag:"log" json:"log" yaml:"log"`
-	Github       Github `json:"github,omitempty" yaml:"github,omitempty"`
-	String       string `flag:"string" json:"string" yaml:"string"`
+	Version string `json:"version" yaml:"version"`
+	Log     Log    `flag:"log" json:"log" yaml:"log"`
+	Github  Github `json:"github,omitempty" yaml:"github,omitempty"`
+	// String is an example of a top level string flag
+	String string `flag:"string" json:"string" yaml:"string"`
+	// LongerString is an example of a flag with a dash in its name
 	LongerString string `flag:"longer-string" json:"longer_string" yaml:"longer_string"`
+	// BufferSize is an example of a byte size, e.g 10MiB
+	BufferSize factor3.ByteSize `flag:"buffer-size" json:"buffer_size" yaml:"buffer_size"`
+	// SampleRate is an example of a percentage, e.g 50%
+	SampleRate factor3.Percent `flag:"sample-rate" json:"sample_rate" validate:"max=100" yaml:"sample_rate"`
 }
 
 type Log struct {
-	Level        string `flag:"level" json:"level" yaml:"level"`
-	Format       string `flag:"format" json:"format" yaml:"format"`
+	Level        string `flag:"level" json:"level" usage:"One of trace, debug, info, warn or error" validate:"oneof=trace debug info warn error" yaml:"level"`
+	Format       string `flag:"format" json:"format" usage:"Either text or json" validate:"oneof=text json" yaml:"format"`
 	LongerString string `flag:"longer-string" json:"longer_string" yaml:"longer_string"`
 }
 
 type Github struct {
-	Token factor3.SecretString `json:"token,omitempty" yaml:"token,omitempty"`
+	Token factor3.SecretString `json:"token,omitempty" required:"true" yaml:"token,omitempty"`
 	App   GithubApp            `json:"app,omitempty" yaml:"app,omitempty"`
 }
 
@@ -34,6 +41,17 @@ type GithubApp struct {
 	InstallationID string `json:"installation_id" yaml:"installation_id"`
 }
 
+func (a GithubApp) Validate() error {
+	if a.InstallationID == "" {
+		return nil
+	}
+	if _, err := strconv.ParseInt(a.InstallationID, 10, 64); err != nil {
+		return fmt.Errorf("installation_id %q is not parsable as integer: %w", a.InstallationID, err)
+	}
+	return nil
+}
+
+// InstallationIDMustInt64 doesn't panic for a config that was loaded successfully, since Validate() checks it
 func (a GithubApp) InstallationIDMustInt64() int64 {
 	i, err := strconv.ParseInt(a.InstallationID, 10, 64)
 	if err != nil {
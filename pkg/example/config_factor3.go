@@ -0,0 +1,14 @@
+// Code generated by factor3gen. DO NOT EDIT.
+
+package example
+
+import "github.com/drornir/factor3/pkg/factor3"
+
+func init() {
+	factor3.RegisterFieldDocs[Config](map[string]string{
+		"String":       "String is an example of a top level string flag",
+		"LongerString": "LongerString is an example of a flag with a dash in its name",
+		"BufferSize":   "BufferSize is an example of a byte size, e.g 10MiB",
+		"SampleRate":   "SampleRate is an example of a percentage, e.g 50%",
+	})
+}
@@ -0,0 +1,9 @@
+package example
+
+import "embed"
+
+// Defaults holds defaults.yaml, which is compiled into the binary and used
+// as the lowest precedence layer of the config
+//
+//go:embed defaults.yaml
+var Defaults embed.FS
@@ -0,0 +1,118 @@
+package factor3
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// ByteSize is a number of bytes, written in config files, env vars and flags in human readable form,
+// using either decimal (KB, MB, GB, ...) or binary (KiB, MiB, GiB, ...) units, e.g `10MiB` or `1.5GB`.
+// A number without a unit is in bytes.
+type ByteSize uint64
+
+const (
+	Byte ByteSize = 1
+
+	KB ByteSize = 1000 * Byte
+	MB ByteSize = 1000 * KB
+	GB ByteSize = 1000 * MB
+	TB ByteSize = 1000 * GB
+	PB ByteSize = 1000 * TB
+	EB ByteSize = 1000 * PB
+
+	KiB ByteSize = 1024 * Byte
+	MiB ByteSize = 1024 * KiB
+	GiB ByteSize = 1024 * MiB
+	TiB ByteSize = 1024 * GiB
+	PiB ByteSize = 1024 * TiB
+	EiB ByteSize = 1024 * PiB
+)
+
+// byteSizeUnits is ordered from the largest unit to the smallest, binary units first
+var byteSizeUnits = []struct {
+	name string
+	size ByteSize
+}{
+	{"EiB", EiB}, {"EB", EB},
+	{"PiB", PiB}, {"PB", PB},
+	{"TiB", TiB}, {"TB", TB},
+	{"GiB", GiB}, {"GB", GB},
+	{"MiB", MiB}, {"MB", MB},
+	{"KiB", KiB}, {"KB", KB},
+	{"B", Byte},
+}
+
+// ParseByteSize parses a human readable byte size, e.g `10MiB` or `1.5GB`. Units are case insensitive.
+func ParseByteSize(s string) (ByteSize, error) {
+	s = strings.TrimSpace(s)
+	numEnd := strings.IndexFunc(s, func(r rune) bool {
+		return (r < '0' || r > '9') && r != '.'
+	})
+	if numEnd < 0 {
+		numEnd = len(s)
+	}
+	num, unit := s[:numEnd], strings.TrimSpace(s[numEnd:])
+	if num == "" {
+		return 0, fmt.Errorf("invalid byte size %q", s)
+	}
+
+	size := Byte
+	if unit != "" {
+		found := false
+		for _, u := range byteSizeUnits {
+			if strings.EqualFold(unit, u.name) {
+				size, found = u.size, true
+				break
+			}
+		}
+		if !found {
+			return 0, fmt.Errorf("invalid byte size %q: unknown unit %q", s, unit)
+		}
+	}
+
+	if i, err := strconv.ParseUint(num, 10, 64); err == nil {
+		if i > math.MaxUint64/uint64(size) {
+			return 0, fmt.Errorf("byte size %q is too large", s)
+		}
+		return ByteSize(i) * size, nil
+	}
+	f, err := strconv.ParseFloat(num, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid byte size %q: %w", s, err)
+	}
+	total := f * float64(size)
+	if total >= math.MaxUint64 {
+		return 0, fmt.Errorf("byte size %q is too large", s)
+	}
+	return ByteSize(math.Round(total)), nil
+}
+
+// String formats the size with the unit that represents it exactly with the smallest number,
+// e.g `10MiB`, `1500MB` or `1B`
+func (b ByteSize) String() string {
+	if b == 0 {
+		return "0B"
+	}
+	best := byteSizeUnits[len(byteSizeUnits)-1]
+	for _, u := range byteSizeUnits {
+		if b%u.size == 0 && b/u.size < b/best.size {
+			best = u
+		}
+	}
+	return strconv.FormatUint(uint64(b/best.size), 10) + best.name
+}
+
+func (b ByteSize) MarshalText() ([]byte, error) {
+	return []byte(b.String()), nil
+}
+
+func (b *ByteSize) UnmarshalText(text []byte) error {
+	parsed, err := ParseByteSize(string(text))
+	if err != nil {
+		return err
+	}
+	*b = parsed
+	return nil
+}
@@ -0,0 +1,129 @@
+package factor3
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+var (
+	registeredDecoders     = map[reflect.Type]func(raw any) (any, error){}
+	registeredDecodersLock sync.RWMutex
+)
+
+// RegisterDecoder registers a function that decodes values of type T, for types you can't add
+// methods to (e.g slog.Level, big.Int or protobuf enums). Fields of type T, and slices and maps of T,
+// are decoded with it from config files, env vars and flags alike.
+//
+// `raw` is a string from env vars and flags, and whatever the parser returned from config files
+// (e.g int, float64, []any or map[string]any). A registered decoder takes precedence over the builtin
+// decoding of T, including encoding.TextUnmarshaler. Call it before Bind(), usually from an init() function.
+func RegisterDecoder[T any](decode func(raw any) (T, error)) {
+	registeredDecodersLock.Lock()
+	defer registeredDecodersLock.Unlock()
+	registeredDecoders[reflect.TypeFor[T]()] = func(raw any) (any, error) {
+		return decode(raw)
+	}
+}
+
+func lookupDecoder(t reflect.Type) (func(raw any) (any, error), bool) {
+	registeredDecodersLock.RLock()
+	defer registeredDecodersLock.RUnlock()
+	dec, ok := registeredDecoders[t]
+	return dec, ok
+}
+
+// decodeValue converts `data` from viper to a new value of type `t`, trying in order: a registered decoder,
+// parseString() for strings (env vars and most flags), element by element decoding of slices and maps,
+// and a json round trip.
+func decodeValue(t reflect.Type, data any) (reflect.Value, error) {
+	if reflect.TypeOf(data) == t {
+		// e.g defaults from Bind()
+		return deepCopy(reflect.ValueOf(data)), nil
+	}
+
+	if dec, ok := lookupDecoder(t); ok {
+		v := reflect.New(t).Elem()
+		decoded, err := dec(data)
+		if err != nil {
+			return v, fmt.Errorf("decoding %v into type %s: %w", data, t, err)
+		}
+		if decoded != nil {
+			v.Set(reflect.ValueOf(decoded))
+		}
+		return v, nil
+	}
+
+	s, ok := data.(string)
+	if !ok && isTextType(t) {
+		switch reflect.ValueOf(data).Kind() {
+		case reflect.Bool,
+			reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+			reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+			reflect.Float32, reflect.Float64:
+			// e.g `level: 1` in yaml, for a type that implements encoding.TextUnmarshaler
+			s, ok = fmt.Sprint(data), true
+		}
+	}
+	if ok && canParseString(t) {
+		v, err := parseString(t, s)
+		if err != nil {
+			return v, fmt.Errorf("unable to parse %q into type %s: %w", s, t, err)
+		}
+		return v, nil
+	}
+	if ok && s != "" && (t.Kind() == reflect.Slice || t.Kind() == reflect.Map || t.Kind() == reflect.Struct) {
+		// e.g an env var with a json list of structs
+		into := reflect.New(t)
+		if err := json.Unmarshal([]byte(s), into.Interface()); err != nil {
+			return into.Elem(), fmt.Errorf("unable to parse %q as json into type %s: %w", s, t, err)
+		}
+		return into.Elem(), nil
+	}
+
+	switch data := data.(type) {
+	case []any:
+		if t.Kind() != reflect.Slice || hasStringForm(t) {
+			break
+		}
+		v := reflect.MakeSlice(t, len(data), len(data))
+		for i, item := range data {
+			e, err := decodeValue(t.Elem(), item)
+			if err != nil {
+				return v, fmt.Errorf("index %d: %w", i, err)
+			}
+			v.Index(i).Set(e)
+		}
+		return v, nil
+	case map[string]any:
+		if t.Kind() != reflect.Map || !canParseString(t.Key()) {
+			break
+		}
+		v := reflect.MakeMapWithSize(t, len(data))
+		for k, item := range data {
+			key, err := parseString(t.Key(), k)
+			if err != nil {
+				return v, fmt.Errorf("key %q: %w", k, err)
+			}
+			e, err := decodeValue(t.Elem(), item)
+			if err != nil {
+				return v, fmt.Errorf("key %q: %w", k, err)
+			}
+			v.SetMapIndex(key, e)
+		}
+		return v, nil
+	}
+
+	// TODO check if I can reuse something from viper
+	into := reflect.New(t)
+	jsonBytes, err := json.Marshal(data)
+	if err != nil {
+		return into.Elem(), fmt.Errorf("viper data is not json serializale: %w", err)
+	}
+	err = json.Unmarshal(jsonBytes, into.Interface())
+	if err != nil {
+		return into.Elem(), fmt.Errorf("unable to parse data %s into type %s: %w", jsonBytes, t, err)
+	}
+	return into.Elem(), nil
+}
@@ -0,0 +1,200 @@
+package factor3
+
+import (
+	"encoding"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/pflag"
+)
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// parseString parses `s` into a new value of type `t`. Slices are `a,b,c` and maps are `k1=v1,k2=v2`, like in pflag.
+// Other types are parsed by their registered decoder, from their human readable form (e.g `30s`),
+// or by themselves when they implement encoding.TextUnmarshaler or pflag.Value.
+func parseString(t reflect.Type, s string) (reflect.Value, error) {
+	v := reflect.New(t).Elem()
+	if _, ok := lookupDecoder(t); ok {
+		return decodeValue(t, s)
+	}
+	if wk, ok := wellKnownTypes[t]; ok {
+		parsed, err := wk.parse(s)
+		if err != nil {
+			return v, err
+		}
+		v.Set(reflect.ValueOf(parsed).Convert(t))
+		return v, nil
+	}
+	if isTextType(t) {
+		var err error
+		switch u := v.Addr().Interface().(type) {
+		case encoding.TextUnmarshaler:
+			err = u.UnmarshalText([]byte(s))
+		case pflag.Value:
+			err = u.Set(s)
+		}
+		return v, err
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return v, err
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, err := strconv.ParseInt(s, 0, t.Bits())
+		if err != nil {
+			return v, err
+		}
+		v.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		i, err := strconv.ParseUint(s, 0, t.Bits())
+		if err != nil {
+			return v, err
+		}
+		v.SetUint(i)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(s, t.Bits())
+		if err != nil {
+			return v, err
+		}
+		v.SetFloat(f)
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Slice:
+		v.Set(reflect.MakeSlice(t, 0, 0))
+		if s == "" {
+			return v, nil
+		}
+		for _, item := range strings.Split(s, ",") {
+			e, err := parseString(t.Elem(), strings.TrimSpace(item))
+			if err != nil {
+				return v, err
+			}
+			v.Set(reflect.Append(v, e))
+		}
+	case reflect.Map:
+		v.Set(reflect.MakeMap(t))
+		if s == "" {
+			return v, nil
+		}
+		for _, pair := range strings.Split(s, ",") {
+			ks, vs, ok := strings.Cut(pair, "=")
+			if !ok {
+				return v, fmt.Errorf("%q must be formatted as key=value", pair)
+			}
+			k, err := parseString(t.Key(), strings.TrimSpace(ks))
+			if err != nil {
+				return v, err
+			}
+			e, err := parseString(t.Elem(), strings.TrimSpace(vs))
+			if err != nil {
+				return v, err
+			}
+			v.SetMapIndex(k, e)
+		}
+	default:
+		return v, fmt.Errorf("parsing %s from a string is not supported", t)
+	}
+	return v, nil
+}
+
+// canParseString reports whether parseString() supports `t`
+func canParseString(t reflect.Type) bool {
+	if hasStringForm(t) {
+		return true
+	}
+	switch t.Kind() {
+	case reflect.Bool,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64,
+		reflect.String:
+		return true
+	case reflect.Slice:
+		return canParseString(t.Elem())
+	case reflect.Map:
+		return canParseString(t.Key()) && canParseString(t.Elem())
+	default:
+		return false
+	}
+}
+
+// plainValue converts `v` to builtin types only, as expected by CEL and by the string comparisons
+// of validation rules. Structs become maps keyed by their config keys.
+func plainValue(v reflect.Value, naming NamingStrategy) any {
+	if wk, ok := wellKnownTypes[v.Type()]; ok {
+		switch v.Type() {
+		case durationType, reflect.TypeFor[time.Time]():
+			return v.Interface()
+		default:
+			return wk.format(v.Interface())
+		}
+	}
+	if v.Kind() == reflect.Struct && isTextType(v.Type()) {
+		return formatString(v)
+	}
+	switch v.Kind() {
+	case reflect.Bool:
+		return v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return v.Uint()
+	case reflect.Float32, reflect.Float64:
+		return v.Float()
+	case reflect.String:
+		return v.String()
+	case reflect.Slice, reflect.Array:
+		s := make([]any, v.Len())
+		for i := range s {
+			s[i] = plainValue(v.Index(i), naming)
+		}
+		return s
+	case reflect.Map:
+		m := make(map[string]any, v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			m[fmt.Sprint(plainValue(iter.Key(), naming))] = plainValue(iter.Value(), naming)
+		}
+		return m
+	case reflect.Struct:
+		m := make(map[string]any, v.NumField())
+		var promoted []map[string]any
+		for i := 0; i < v.NumField(); i++ {
+			f := v.Type().Field(i)
+			if skipField(f) {
+				continue
+			}
+			if isSquashed(f) {
+				if pm, ok := plainValue(v.Field(i), naming).(map[string]any); ok {
+					promoted = append(promoted, pm)
+				}
+				continue
+			}
+			m[toJSONName(f, naming)] = plainValue(v.Field(i), naming)
+		}
+		// fields of the struct itself take precedence over promoted ones
+		for _, pm := range promoted {
+			for k, pv := range pm {
+				if _, ok := m[k]; !ok {
+					m[k] = pv
+				}
+			}
+		}
+		return m
+	case reflect.Pointer, reflect.Interface:
+		if v.IsNil() {
+			return nil
+		}
+		return plainValue(v.Elem(), naming)
+	default:
+		return v.Interface()
+	}
+}
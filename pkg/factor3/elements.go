@@ -0,0 +1,478 @@
+package factor3
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/pflag"
+)
+
+// elementLeaf is a value inside the element type of a slice of structs
+type elementLeaf struct {
+	// keys is the path of config keys from the element to the value
+	keys []string
+	// index is the path of field indexes from the element to the value, through pointers
+	index []int
+	// flag is the flag name of the value relative to the element, or empty if it has no flag
+	flag  string
+	field visitedField
+	// typ is the type of the value, which is the type of the field without pointers
+	typ reflect.Type
+}
+
+// elementFlag is a flag of a value in the element at `elem` of a slice of structs, e.g --upstreams-0-host
+type elementFlag struct {
+	flag *pflag.Flag
+	elem int
+	leaf elementLeaf
+}
+
+// elementLeaves lists the values inside the struct type `t`, like visit() would
+func (l *Loader) elementLeaves(t reflect.Type, keys []string, index []int, flags []string) []elementLeaf {
+	var leaves []elementLeaf
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if skipField(f) {
+			continue
+		}
+		fkeys, fflags := keys, flags
+		if !isSquashed(f) {
+			fkeys = append(slices.Clone(keys), l.keyName(f))
+			fflags = append(slices.Clone(flags), l.flagName(f))
+		}
+		findex := append(slices.Clone(index), i)
+		ft := f.Type
+		for ft.Kind() == reflect.Pointer && !hasStringForm(ft) {
+			ft = ft.Elem()
+		}
+		if ft.Kind() == reflect.Struct && !hasStringForm(ft) {
+			leaves = append(leaves, l.elementLeaves(ft, fkeys, findex, fflags)...)
+			continue
+		}
+		leaf := elementLeaf{keys: fkeys, index: findex, field: visitedField{StructField: f, parent: t}, typ: ft}
+		if len(fflags) > 0 && fflags[len(fflags)-1] != "" {
+			leaf.flag = strings.Join(slices.DeleteFunc(fflags, func(s string) bool { return s == "" }), l.flagSeparator)
+		}
+		leaves = append(leaves, leaf)
+	}
+	return leaves
+}
+
+// structElem is the struct type of the elements of slices and maps of structs (or of pointers to structs)
+func structElem(t reflect.Type) (reflect.Type, bool) {
+	if hasStringForm(t) {
+		return nil, false
+	}
+	if t.Kind() != reflect.Slice && (t.Kind() != reflect.Map || !canParseString(t.Key())) {
+		return nil, false
+	}
+	et := t.Elem()
+	if et.Kind() == reflect.Pointer {
+		et = et.Elem()
+	}
+	return et, et.Kind() == reflect.Struct && !hasStringForm(et)
+}
+
+// registerElements lets env vars set the values in the elements of slices and maps of structs,
+// e.g EXAMPLE_UPSTREAMS_0_HOST or EXAMPLE_TENANTS_ACME_QUOTA, and flags those of slices, e.g --upstreams-0-host.
+// The `required` and `validate` tags in the elements are checked by checkElements(), and their rules by evalRules().
+func (l *Loader) registerElements(v reflect.Value) error {
+	et, ok := structElem(v.Type())
+	if !ok || l.viper == nil {
+		return nil
+	}
+	viperPath := l.jpathString()
+	index := slices.Clone(l.index)
+	leaves := l.elementLeaves(et, nil, nil, nil)
+
+	var flags []elementFlag
+	flagsPath := ""
+	if l.pflagset != nil && l.hasFlag() && v.Kind() == reflect.Slice {
+		flagsPath = l.fpathString()
+		n, err := l.flagElements(v)
+		if err != nil {
+			return err
+		}
+		for i := range n {
+			for _, leaf := range leaves {
+				if leaf.flag == "" {
+					continue
+				}
+				name := strings.Join([]string{flagsPath, strconv.Itoa(i), leaf.flag}, l.flagSeparator)
+				if l.pflagset.Lookup(name) != nil {
+					return l.errWithContext(fmt.Sprintf("flag --%s is already defined", name), v, viperPath)
+				}
+				fv := newFlagValue(reflect.New(leaf.typ).Elem())
+				f := l.pflagset.VarPF(fv, name, "", leaf.field.description())
+				if leaf.typ.Kind() == reflect.Bool {
+					f.NoOptDefVal = "true"
+				}
+				l.elementFlagNames[name] = true
+				l.viper.state.trackUsage(flagUsage{
+					flag:        f,
+					description: leaf.field.description(),
+					viperPath:   strings.Join(append([]string{viperPath, strconv.Itoa(i)}, leaf.keys...), "."),
+				})
+				flags = append(flags, elementFlag{flag: f, elem: i, leaf: leaf})
+			}
+		}
+	}
+
+	for _, leaf := range leaves {
+		c := elementCheck{viperPath: viperPath, flagsPath: flagsPath, index: index, leaf: leaf}
+		_, hasDefault := leaf.field.Tag.Lookup("default")
+		c.required = isRequired(leaf.field.StructField) && !hasDefault
+		if tag := leaf.field.Tag.Get("validate"); tag != "" {
+			rules, err := parseValidateTag(leaf.typ, tag)
+			if err != nil {
+				return l.errWithContext(fmt.Sprintf("invalid validate tag %q of %s: %s", tag, strings.Join(leaf.keys, "."), err), v, viperPath)
+			}
+			c.rules = rules
+		}
+		if c.required || len(c.rules) > 0 {
+			l.elementChecks = append(l.elementChecks, c)
+		}
+	}
+
+	rules, err := l.compileElementRules(et, viperPath, index, nil, nil)
+	if err != nil {
+		return l.errWithContext(err.Error(), v, viperPath)
+	}
+	l.elementRules = append(l.elementRules, rules...)
+
+	l.loaders = append(l.loaders, func(root reflect.Value) error {
+		fv := fieldByIndex(root, index)
+		if !fv.IsValid() {
+			return nil
+		}
+		for _, o := range l.elementOverrides(viperPath, leaves, flags, fv.Kind() == reflect.Map) {
+			if err := o.setIn(fv); err != nil {
+				return l.errWithContext(err.Error(), fv, viperPath+"."+o.name())
+			}
+		}
+		return nil
+	})
+	return nil
+}
+
+// flagElements is the number of elements of the slice `v` that get flags, raised by a `flagElements:"N"` tag
+func (l *Loader) flagElements(v reflect.Value) (int, error) {
+	s, ok := l.currentField().Tag.Lookup("flagElements")
+	if !ok {
+		return v.Len(), nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 {
+		return 0, l.errWithContext(fmt.Sprintf("invalid flagElements tag %q", s), v, l.jpathString())
+	}
+	return max(v.Len(), n), nil
+}
+
+// elementCheck holds the `required` and `validate` tags of a value in the elements of a slice or map of structs
+type elementCheck struct {
+	viperPath string
+	// flagsPath is the flag name of the slice, or empty if its elements have no flags
+	flagsPath string
+	index     []int
+	leaf      elementLeaf
+	required  bool
+	rules     []validationRule
+}
+
+// checkElements checks the values in the elements of slices and maps of structs.
+// Since their sources aren't tracked, zero values count as missing.
+func (l *Loader) checkElements(root reflect.Value) []error {
+	var errs []error
+	for i := len(l.elementChecks) - 1; i >= 0; i-- {
+		c := l.elementChecks[i]
+		collection := fieldByIndex(root, c.index)
+		if !collection.IsValid() {
+			continue
+		}
+		for _, name := range elementNames(collection) {
+			v := c.leaf.valueIn(elementByName(collection, name))
+			path := strings.Join(append([]string{c.viperPath, name}, c.leaf.keys...), ".")
+			if !v.IsValid() || v.IsZero() {
+				if c.required {
+					errs = append(errs, MissingValueError{Path: path, Env: l.elementEnvName(c, name), Flag: l.elementFlagName(c, name)})
+				}
+				continue
+			}
+			for _, r := range c.rules {
+				if err := r.check(v); err != nil {
+					errs = append(errs, FieldError{Path: path, Rule: r.tag, Value: v.Interface(), Err: err})
+				}
+			}
+		}
+	}
+	return errs
+}
+
+// elementNames are the indexes of a slice or the sorted keys of a map, as written in paths
+func elementNames(collection reflect.Value) []string {
+	var names []string
+	if collection.Kind() == reflect.Slice {
+		for i := range collection.Len() {
+			names = append(names, strconv.Itoa(i))
+		}
+		return names
+	}
+	iter := collection.MapRange()
+	for iter.Next() {
+		names = append(names, fmt.Sprint(iter.Key().Interface()))
+	}
+	slices.Sort(names)
+	return names
+}
+
+func elementByName(collection reflect.Value, name string) reflect.Value {
+	if collection.Kind() == reflect.Slice {
+		i, _ := strconv.Atoi(name)
+		return collection.Index(i)
+	}
+	iter := collection.MapRange()
+	for iter.Next() {
+		if fmt.Sprint(iter.Key().Interface()) == name {
+			return iter.Value()
+		}
+	}
+	return reflect.Value{}
+}
+
+// valueIn is the value of the leaf in `elem`, or the invalid Value when a pointer on the way is nil
+func (leaf elementLeaf) valueIn(elem reflect.Value) reflect.Value {
+	v := reflect.Indirect(elem)
+	for _, i := range leaf.index {
+		if !v.IsValid() {
+			return v
+		}
+		v = reflect.Indirect(v.Field(i))
+	}
+	return v
+}
+
+func (l *Loader) elementEnvName(c elementCheck, name string) string {
+	sep := l.viper.state.envKeySeparator()
+	suffix := sep + strings.ToUpper(strings.Join(append([]string{name}, c.leaf.keys...), sep))
+	names := strings.Split(l.viper.state.envName(c.viperPath), " or ")
+	for i := range names {
+		names[i] += suffix
+	}
+	return strings.Join(names, " or ")
+}
+
+// elementFlagName is the flag of the leaf in the element `name`, or empty if there's no flag for it
+func (l *Loader) elementFlagName(c elementCheck, name string) string {
+	if c.flagsPath == "" || c.leaf.flag == "" {
+		return ""
+	}
+	flagName := strings.Join([]string{c.flagsPath, name, c.leaf.flag}, l.flagSeparator)
+	if !l.elementFlagNames[flagName] {
+		return ""
+	}
+	return flagName
+}
+
+// elementOverride is a value from an env var or a flag for an element, or the whole element in json when leaf is nil
+type elementOverride struct {
+	// elem is the index of the element in a slice
+	elem int
+	// key is the key of the element in a map, as written in the env var
+	key  string
+	leaf *elementLeaf
+	raw  string
+}
+
+func (o elementOverride) name() string {
+	if o.key != "" {
+		return o.key
+	}
+	return strconv.Itoa(o.elem)
+}
+
+// setIn sets the value in the slice or map `collection`, adding the element if it's missing.
+// A slice only grows by one element at a time, so an index past its end is an error.
+func (o elementOverride) setIn(collection reflect.Value) error {
+	if collection.Kind() == reflect.Slice {
+		if o.elem > collection.Len() {
+			return fmt.Errorf("index %d is out of range, the slice has %d elements", o.elem, collection.Len())
+		}
+		if o.elem == collection.Len() {
+			collection.Set(reflect.Append(collection, newElement(collection.Type().Elem())))
+		}
+		return o.apply(derefAlloc(collection.Index(o.elem)))
+	}
+
+	if collection.IsNil() {
+		collection.Set(reflect.MakeMap(collection.Type()))
+	}
+	key, err := mapKey(collection, o.key)
+	if err != nil {
+		return err
+	}
+	elem := reflect.New(collection.Type().Elem()).Elem()
+	if existing := collection.MapIndex(key); existing.IsValid() {
+		elem.Set(deepCopy(existing))
+	} else {
+		elem.Set(newElement(elem.Type()))
+	}
+	if err := o.apply(derefAlloc(elem)); err != nil {
+		return err
+	}
+	collection.SetMapIndex(key, elem)
+	return nil
+}
+
+// apply sets the value in `elem`, which is a struct
+func (o elementOverride) apply(elem reflect.Value) error {
+	if o.leaf == nil {
+		v, err := decodeValue(elem.Type(), o.raw)
+		if err != nil {
+			return err
+		}
+		elem.Set(v)
+		return nil
+	}
+	f := elem
+	for _, i := range o.leaf.index {
+		f = derefAlloc(f.Field(i))
+	}
+	v, err := decodeValue(f.Type(), o.raw)
+	if err != nil {
+		return fmt.Errorf("%s: %w", strings.Join(o.leaf.keys, "."), err)
+	}
+	f.Set(v)
+	return nil
+}
+
+// mapKey finds the key of `m` that matches `name` from an env var case insensitively,
+// or creates a lower case key, since env var names are upper case
+func mapKey(m reflect.Value, name string) (reflect.Value, error) {
+	iter := m.MapRange()
+	for iter.Next() {
+		if strings.EqualFold(fmt.Sprint(iter.Key().Interface()), name) {
+			return iter.Key(), nil
+		}
+	}
+	return parseString(m.Type().Key(), strings.ToLower(name))
+}
+
+// elementOverrides finds the values set for the elements at `viperPath` by env vars and then by flags of each element.
+// It skips env vars of other keys, and env vars of whole elements that don't hold a json object.
+func (l *Loader) elementOverrides(viperPath string, leaves []elementLeaf, flags []elementFlag, isMap bool) []elementOverride {
+	st := l.viper.state
+	sep := st.envKeySeparator()
+	bound := st.boundEnvNames()
+	var overrides []elementOverride
+	for _, prefix := range st.envNames(viperPath) {
+		for _, kv := range os.Environ() {
+			name, raw, _ := strings.Cut(kv, "=")
+			rest, ok := strings.CutPrefix(name, prefix+sep)
+			if !ok || bound[name] {
+				continue // e.g TEST_TENANTS_LIMIT of tenants_limit, next to tenants
+			}
+			var o elementOverride
+			if isMap {
+				o, ok = mapOverride(rest, sep, leaves)
+			} else {
+				o, ok = sliceOverride(rest, sep, leaves)
+			}
+			if ok && (o.leaf != nil || isJSONObject(raw)) {
+				o.raw = raw
+				overrides = append(overrides, o)
+			}
+		}
+	}
+	for _, ef := range flags {
+		if ef.flag.Changed {
+			overrides = append(overrides, elementOverride{elem: ef.elem, leaf: &ef.leaf, raw: ef.flag.Value.String()})
+		}
+	}
+	// by index, so slices grow in order, and whole elements first, so the values of their fields can override them
+	slices.SortStableFunc(overrides, func(a, b elementOverride) int {
+		if a.elem != b.elem {
+			return a.elem - b.elem
+		}
+		if (a.leaf == nil) == (b.leaf == nil) {
+			return 0
+		}
+		if a.leaf == nil {
+			return -1
+		}
+		return 1
+	})
+	return overrides
+}
+
+// sliceOverride parses `rest` of an env var name after the name of a slice, e.g `0_HOST`
+func sliceOverride(rest, sep string, leaves []elementLeaf) (elementOverride, bool) {
+	elemStr, leafName, hasLeaf := strings.Cut(rest, sep)
+	elem, err := strconv.Atoi(elemStr)
+	if err != nil || elem < 0 {
+		return elementOverride{}, false
+	}
+	if !hasLeaf {
+		return elementOverride{elem: elem}, true
+	}
+	for i := range leaves {
+		if strings.EqualFold(leafName, strings.Join(leaves[i].keys, sep)) {
+			return elementOverride{elem: elem, leaf: &leaves[i]}, true
+		}
+	}
+	return elementOverride{}, false
+}
+
+// mapOverride parses `rest` of an env var name after the name of a map, e.g `ACME_QUOTA`,
+// using the longest value name it ends with, since keys can contain the separator
+func mapOverride(rest, sep string, leaves []elementLeaf) (elementOverride, bool) {
+	var o elementOverride
+	longest := 0
+	for i := range leaves {
+		suffix := sep + strings.Join(leaves[i].keys, sep)
+		if len(rest) > len(suffix) && len(suffix) > longest && strings.HasSuffix(strings.ToUpper(rest), strings.ToUpper(suffix)) {
+			o = elementOverride{key: rest[:len(rest)-len(suffix)], leaf: &leaves[i]}
+			longest = len(suffix)
+		}
+	}
+	if o.leaf == nil {
+		o.key = rest
+	}
+	return o, rest != ""
+}
+
+func isJSONObject(raw string) bool {
+	return strings.HasPrefix(strings.TrimSpace(raw), "{")
+}
+
+// newElement creates a new element of a slice or a map of structs, with the defaults of its type
+func newElement(t reflect.Type) reflect.Value {
+	p := reflect.New(t)
+	elem := derefAlloc(p.Elem())
+	applyDefaulters(elem)
+	applyDefaultTags(elem)
+	return p.Elem()
+}
+
+// applyDefaultTags sets the fields of the struct `v` from their `default:"..."` tags
+func applyDefaultTags(v reflect.Value) {
+	for i := 0; i < v.NumField(); i++ {
+		f := v.Type().Field(i)
+		if skipField(f) {
+			continue
+		}
+		fv := v.Field(i)
+		if s, ok := f.Tag.Lookup("default"); ok && fv.IsZero() {
+			if def, err := parseString(fv.Type(), s); err == nil {
+				fv.Set(def)
+			}
+			continue
+		}
+		if fv.Kind() == reflect.Struct && !hasStringForm(fv.Type()) {
+			applyDefaultTags(fv)
+		}
+	}
+}
@@ -3,6 +3,7 @@ package factor3
 import (
 	"errors"
 	"fmt"
+	"strings"
 )
 
 type ParseError struct {
@@ -24,3 +25,74 @@ func (e LoadError) Error() string {
 	return fmt.Sprintf("config load errors: %s", errors.Join(e.Errs...).Error())
 }
 func (e LoadError) Unwrap() []error { return e.Errs }
+
+// MissingValueError is one of the errors in LoadError, for a required field that was not set by any source
+type MissingValueError struct {
+	// Path is the key of the field in config files
+	Path string
+	// Env is the name of the env var that sets the field, or its names joined with " or "
+	// when it has an `env:"..."` tag
+	Env string
+	// Flag is the name of the flag that sets the field, or empty if there's no flag for it
+	Flag string
+}
+
+func (e MissingValueError) Error() string {
+	msg := fmt.Sprintf("missing required value %q: set it in a config file, or with env var %s", e.Path, e.Env)
+	if e.Flag != "" {
+		msg += fmt.Sprintf(", or with flag --%s", e.Flag)
+	}
+	return msg
+}
+
+// FieldError is one of the errors in LoadError, for a field whose value failed a rule from its `validate:"..."` tag
+type FieldError struct {
+	// Path is the key of the field in config files
+	Path string
+	// Rule is the rule that failed, as written in the tag
+	Rule string
+	// Value is the value that failed validation
+	Value any
+	Err   error
+}
+
+func (e FieldError) Error() string {
+	return fmt.Sprintf("invalid value %v for %q (%s): %s", e.Value, e.Path, e.Rule, e.Err.Error())
+}
+func (e FieldError) Unwrap() error { return e.Err }
+
+// RuleError is one of the errors in LoadError, for a rule registered with RegisterRule() that did not pass
+type RuleError struct {
+	// Rule is the CEL expression
+	Rule string
+	// Paths are the config keys the expression refers to
+	Paths []string
+	// Err is set if the rule could not be evaluated, and nil if it evaluated to false
+	Err error
+}
+
+func (e RuleError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("rule %q on %s could not be evaluated: %s", e.Rule, strings.Join(e.Paths, ", "), e.Err.Error())
+	}
+	return fmt.Sprintf("rule %q failed on %s", e.Rule, strings.Join(e.Paths, ", "))
+}
+func (e RuleError) Unwrap() error { return e.Err }
+
+// HookError is one of the errors in LoadError, for a struct whose Validate() or AfterLoad() method returned an error
+type HookError struct {
+	// Path is the key of the struct in config files, e.g `servers[0]` or `tenants.acme`
+	// for elements of slices and maps, and empty for the root struct
+	Path string
+	// Hook is the name of the method, e.g "Validate"
+	Hook string
+	Err  error
+}
+
+func (e HookError) Error() string {
+	if e.Path == "" {
+		return fmt.Sprintf("%s(): %s", e.Hook, e.Err.Error())
+	}
+	return fmt.Sprintf("%s() of %q: %s", e.Hook, e.Path, e.Err.Error())
+}
+func (e HookError) Unwrap() error { return e.Err }
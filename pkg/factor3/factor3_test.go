@@ -1,10 +1,27 @@
 package factor3_test
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"math/big"
+	"net"
+	"net/url"
 	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
 	"sync"
 	"testing"
+	"testing/fstest"
+	"time"
 
+	"github.com/fsnotify/fsnotify"
 	"github.com/spf13/afero"
 	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
@@ -43,6 +60,7 @@ github:
 		name      string
 		filename  string
 		envPrefix string
+		defaults  fs.FS
 		env       map[string]string
 		flags     []string
 
@@ -71,6 +89,27 @@ github:
 				assert.Equal(t, "loglongstringflag", value.Log.LongerString)
 			},
 		},
+		{
+			name:     "test_embedded_defaults",
+			filename: "ex1.yaml",
+			defaults: fstest.MapFS{"defaults.yaml": {Data: []byte(`
+log:
+  format: json
+  longer_string: from-defaults
+string: from-defaults
+`)}},
+			env: map[string]string{
+				"TEST_EMBEDDED_DEFAULTS_GITHUB_TOKEN": "my-secret-token",
+			},
+			flags: []string{
+				"--string", "fromflag",
+			},
+			checks: func(t *testing.T, value example.Config) {
+				assert.Equal(t, "text", value.Log.Format, "config file overrides defaults")
+				assert.Equal(t, "from-defaults", value.Log.LongerString)
+				assert.Equal(t, "fromflag", value.String, "flags override defaults")
+			},
+		},
 	}
 
 	for _, tc := range testCases {
@@ -90,7 +129,7 @@ github:
 				}(k)
 			}
 
-			viperInstance := viper.New()
+			viperInstance := factor3.NewViper(viper.New())
 			viperInstance.SetFs(tFileSys)
 			viperInstance.AllowEmptyEnv(true) // maybe I should set it for everyone. it's a legacy feature to turn it off
 
@@ -99,6 +138,7 @@ github:
 				Viper:       viperInstance,
 				ProgramName: tc.name,
 				CfgFile:     tc.filename,
+				Defaults:    tc.defaults,
 			})
 			require.NoError(t, err, "factor3.InitializeViper() on %q", tc.filename)
 
@@ -116,3 +156,1588 @@ github:
 		})
 	}
 }
+
+func TestEmbeddedDefaultsUnknownKey(t *testing.T) {
+	tFileSys := afero.NewMemMapFs()
+	require.NoError(t, afero.WriteFile(tFileSys, "empty.yaml", nil, 0o644))
+	viperInstance := factor3.NewViper(viper.New())
+	viperInstance.SetFs(tFileSys)
+	err := factor3.InitializeViper(factor3.InitArgs{
+		Viper:       viperInstance,
+		ProgramName: "test_defaults_unknown",
+		CfgFile:     "empty.yaml",
+		Defaults: fstest.MapFS{"defaults.yml": {Data: []byte(`
+log:
+  level: info
+  colour: red
+`)}},
+		DefaultsFile: "defaults.yml",
+	})
+	require.NoError(t, err, "factor3.InitializeViper()")
+
+	var conf example.Config
+	_, err = factor3.Bind(&conf, viperInstance, pflag.NewFlagSet(t.Name(), pflag.ContinueOnError))
+	var perr factor3.ParseError
+	require.ErrorAs(t, err, &perr)
+	assert.ErrorContains(t, err, `"log.colour"`)
+}
+
+// bindTest writes `config` to an in memory config.yaml, initializes a fresh viper with
+// the "test" program name (env prefix "TEST_"), and binds `into` to it
+func bindTest(t *testing.T, into any, config string, opts ...factor3.Option) (*factor3.Loader, *factor3.Viper, *pflag.FlagSet, error) {
+	t.Helper()
+	tFileSys := afero.NewMemMapFs()
+	require.NoError(t, afero.WriteFile(tFileSys, "config.yaml", []byte(config), 0o644))
+	viperInstance := factor3.NewViper(viper.New())
+	viperInstance.SetFs(tFileSys)
+	err := factor3.InitializeViper(factor3.InitArgs{
+		Viper:       viperInstance,
+		ProgramName: "test",
+		CfgFile:     "config.yaml",
+	})
+	require.NoError(t, err, "factor3.InitializeViper()")
+
+	flagset := pflag.NewFlagSet(t.Name(), pflag.ContinueOnError)
+	loader, err := factor3.Bind(into, viperInstance, flagset, opts...)
+	return loader, viperInstance, flagset, err
+}
+
+func TestDefaultTag(t *testing.T) {
+	type Config struct {
+		Name    string         `flag:"name" json:"name" default:"anonymous"`
+		Port    int            `flag:"port" json:"port" default:"8080"`
+		Timeout time.Duration  `json:"timeout" default:"30s"`
+		Tags    []string       `json:"tags" default:"a, b"`
+		Limits  map[string]int `json:"limits" default:"read=10,write=5"`
+	}
+
+	var conf Config
+	loader, viperInstance, flagset, err := bindTest(t, &conf, "name: from-file\n")
+	require.NoError(t, err, "factor3.Bind()")
+	assert.Equal(t, "8080", flagset.Lookup("port").DefValue)
+	assert.Equal(t, "anonymous", flagset.Lookup("name").DefValue)
+	assert.Equal(t, "30s", viperInstance.Get("timeout"), "tag defaults are viper defaults")
+
+	require.NoError(t, flagset.Parse([]string{"--port", "9090"}))
+	require.NoError(t, loader.Load(), "factor3.Load()")
+
+	assert.Equal(t, "from-file", conf.Name)
+	assert.Equal(t, 9090, conf.Port)
+	assert.Equal(t, 30*time.Second, conf.Timeout)
+	assert.Equal(t, []string{"a", "b"}, conf.Tags)
+	assert.Equal(t, map[string]int{"read": 10, "write": 5}, conf.Limits)
+
+	type BadConfig struct {
+		Port int `json:"port" default:"eighty"`
+	}
+	_, _, _, err = bindTest(t, &BadConfig{}, "")
+	var perr factor3.ParseError
+	require.ErrorAs(t, err, &perr)
+}
+
+func TestDefaultsPrecedence(t *testing.T) {
+	type Config struct {
+		Name    string        `flag:"name" json:"name" default:"from-tag"`
+		Timeout time.Duration `json:"timeout" default:"30s"`
+		Port    int           `json:"port" default:"8080"`
+	}
+	defaults := fstest.MapFS{"defaults.yaml": {Data: []byte("name: from-defaults-file\ntimeout: 1m\n")}}
+	tFileSys := afero.NewMemMapFs()
+	require.NoError(t, afero.WriteFile(tFileSys, "config.yaml", nil, 0o644))
+
+	for _, initFirst := range []bool{true, false} {
+		t.Run(fmt.Sprintf("InitializeViper() first: %v", initFirst), func(t *testing.T) {
+			viperInstance := factor3.NewViper(viper.New())
+			viperInstance.SetFs(tFileSys)
+			initialize := func() {
+				require.NoError(t, factor3.InitializeViper(factor3.InitArgs{
+					Viper:       viperInstance,
+					ProgramName: "test",
+					CfgFile:     "config.yaml",
+					Defaults:    defaults,
+				}), "factor3.InitializeViper()")
+			}
+			if initFirst {
+				initialize()
+			}
+			var conf Config
+			flagset := pflag.NewFlagSet(t.Name(), pflag.ContinueOnError)
+			loader, err := factor3.Bind(&conf, viperInstance, flagset)
+			require.NoError(t, err, "factor3.Bind()")
+			if !initFirst {
+				initialize()
+			}
+			require.NoError(t, flagset.Parse(nil))
+			require.NoError(t, loader.Load(), "factor3.Load()")
+			assert.Equal(t, Config{Name: "from-defaults-file", Timeout: time.Minute, Port: 8080}, conf)
+			assert.Equal(t, map[string]any{"name": "from-defaults-file", "timeout": "1m", "port": "8080"}, viperInstance.AllSettings())
+		})
+	}
+}
+
+func TestRequired(t *testing.T) {
+	type Config struct {
+		Name  string `flag:"name" json:"name" required:"true"`
+		Token string `json:"token" factor3:"required"`
+		Port  int    `json:"port" required:"true" default:"80"`
+		Extra string `json:"extra"`
+	}
+
+	var conf Config
+	loader, _, flagset, err := bindTest(t, &conf, "")
+	require.NoError(t, err, "factor3.Bind()")
+	require.NoError(t, flagset.Parse(nil))
+
+	err = loader.Load()
+	var lerr factor3.LoadError
+	require.ErrorAs(t, err, &lerr)
+	require.Len(t, lerr.Errs, 2)
+	assert.Equal(t, factor3.MissingValueError{Path: "name", Env: "TEST_NAME", Flag: "name"}, lerr.Errs[0])
+	assert.Equal(t, factor3.MissingValueError{Path: "token", Env: "TEST_TOKEN"}, lerr.Errs[1])
+
+	t.Setenv("TEST_TOKEN", "from-env")
+	require.NoError(t, flagset.Parse([]string{"--name", "from-flag"}))
+	require.NoError(t, loader.Load(), "factor3.Load()")
+	assert.Equal(t, "from-flag", conf.Name)
+	assert.Equal(t, "from-env", conf.Token)
+}
+
+func TestRequiredWithoutFlag(t *testing.T) {
+	type Log struct {
+		Sink string `json:"sink" required:"true"`
+	}
+	type TLS struct {
+		Cert string `json:"cert" required:"true"`
+	}
+	type Config struct {
+		Log Log  `flag:"log" json:"log"`
+		TLS *TLS `flag:"tls" json:"tls"`
+	}
+
+	var conf Config
+	loader, _, flagset, err := bindTest(t, &conf, "tls: {}")
+	require.NoError(t, err, "factor3.Bind()")
+	require.NoError(t, flagset.Parse(nil))
+
+	err = loader.Load()
+	var lerr factor3.LoadError
+	require.ErrorAs(t, err, &lerr)
+	require.Len(t, lerr.Errs, 2)
+	assert.Equal(t, factor3.MissingValueError{Path: "log.sink", Env: "TEST_LOG_SINK"}, lerr.Errs[0])
+	assert.Equal(t, factor3.MissingValueError{Path: "tls.cert", Env: "TEST_TLS_CERT"}, lerr.Errs[1])
+}
+
+func TestValidateTag(t *testing.T) {
+	type Config struct {
+		Level    string        `flag:"level" json:"level" validate:"oneof=debug info"`
+		Workers  int           `flag:"workers" json:"workers" validate:"min=1,max=16"`
+		Timeout  time.Duration `json:"timeout" default:"5s" validate:"max=1m"`
+		Name     string        `flag:"name" json:"name" validate:"min=2,regexp=^[a-z]+(,[a-z]+)*$"`
+		Endpoint string        `flag:"endpoint" json:"endpoint" validate:"url"`
+		Listen   string        `flag:"listen" json:"listen" validate:"hostport"`
+		Hosts    []string      `json:"hosts" validate:"max=2,hostport"`
+	}
+
+	var conf Config
+	loader, _, flagset, err := bindTest(t, &conf, `
+level: info
+workers: 4
+name: a,b
+hosts: ["localhost:80"]
+`)
+	require.NoError(t, err, "factor3.Bind()")
+	require.NoError(t, flagset.Parse(nil))
+	require.NoError(t, loader.Load(), "factor3.Load()")
+	assert.Equal(t, "info", conf.Level)
+	assert.Equal(t, "a,b", conf.Name)
+
+	require.NoError(t, flagset.Parse([]string{
+		"--level", "trace",
+		"--workers", "17",
+		"--name", "Bob",
+		"--endpoint", "localhost",
+		"--listen", "localhost:http",
+	}))
+	err = loader.Load()
+	var lerr factor3.LoadError
+	require.ErrorAs(t, err, &lerr)
+	var rules []string
+	for _, e := range lerr.Errs {
+		var ferr factor3.FieldError
+		require.ErrorAs(t, e, &ferr)
+		rules = append(rules, ferr.Path+" "+ferr.Rule)
+	}
+	assert.Equal(t, []string{
+		"level oneof=debug info",
+		"workers max=16",
+		"name regexp=^[a-z]+(,[a-z]+)*$",
+		"endpoint url",
+		"listen hostport",
+	}, rules)
+	assert.Equal(t, "info", conf.Level, "nothing is applied when validation fails")
+	assert.Equal(t, 4, conf.Workers, "nothing is applied when validation fails")
+
+	conf = Config{}
+	loader, _, flagset, err = bindTest(t, &conf, `
+level: ""
+workers: 0
+`)
+	require.NoError(t, err, "factor3.Bind()")
+	require.NoError(t, flagset.Parse(nil))
+	require.ErrorAs(t, loader.Load(), &lerr, "zero values that are set are validated")
+	rules = nil
+	for _, e := range lerr.Errs {
+		var ferr factor3.FieldError
+		require.ErrorAs(t, e, &ferr)
+		rules = append(rules, ferr.Path+" "+ferr.Rule)
+	}
+	assert.Equal(t, []string{"level oneof=debug info", "workers min=1"}, rules)
+
+	type BadConfig struct {
+		Port int `json:"port" validate:"regexp=^[0-9]+$"`
+	}
+	_, _, _, err = bindTest(t, &BadConfig{}, "")
+	var perr factor3.ParseError
+	require.ErrorAs(t, err, &perr)
+}
+
+type ruleTestTLS struct {
+	Enabled  bool   `flag:"enabled" json:"enabled"`
+	CertFile string `json:"cert_file"`
+}
+
+type ruleTestConfig struct {
+	TLS ruleTestTLS `flag:"tls" json:"tls"`
+	Min int         `flag:"min" json:"min"`
+	Max int         `flag:"max" json:"max"`
+}
+
+type ruleTestRange struct {
+	Min int          `json:"min"`
+	Max int          `json:"max"`
+	TLS *ruleTestTLS `json:"tls"`
+}
+
+func init() {
+	factor3.RegisterRule[ruleTestTLS](`!self.enabled || self.cert_file != ""`)
+	factor3.RegisterRule[ruleTestConfig](`self.min < self.max`)
+	factor3.RegisterRule[ruleTestRange](`self.min < self.max`)
+}
+
+func TestRegisterRule(t *testing.T) {
+	var conf ruleTestConfig
+	loader, _, flagset, err := bindTest(t, &conf, `
+min: 1
+max: 10
+`)
+	require.NoError(t, err, "factor3.Bind()")
+	require.NoError(t, flagset.Parse(nil))
+	require.NoError(t, loader.Load(), "factor3.Load()")
+	assert.Equal(t, 10, conf.Max)
+
+	require.NoError(t, flagset.Parse([]string{"--tls-enabled", "--min", "20"}))
+	err = loader.Load()
+	var lerr factor3.LoadError
+	require.ErrorAs(t, err, &lerr)
+	require.Len(t, lerr.Errs, 2)
+	assert.Equal(t, factor3.RuleError{Rule: `self.min < self.max`, Paths: []string{"max", "min"}}, lerr.Errs[0])
+	assert.Equal(t, factor3.RuleError{Rule: `!self.enabled || self.cert_file != ""`, Paths: []string{"tls.cert_file", "tls.enabled"}}, lerr.Errs[1])
+	assert.Equal(t, 1, conf.Min, "nothing is applied when a rule fails")
+}
+
+func TestRegisterRuleElements(t *testing.T) {
+	type Config struct {
+		Ranges []ruleTestRange          `json:"ranges"`
+		Named  map[string]ruleTestRange `json:"named"`
+	}
+
+	var conf Config
+	loader, _, flagset, err := bindTest(t, &conf, `
+ranges:
+  - {min: 1, max: 2}
+  - {min: 5, max: 3, tls: {enabled: true}}
+named:
+  a: {min: 3, max: 1}
+  b: {min: 1, max: 3}
+`)
+	require.NoError(t, err, "factor3.Bind()")
+	require.NoError(t, flagset.Parse(nil))
+	var lerr factor3.LoadError
+	require.ErrorAs(t, loader.Load(), &lerr)
+	assert.ElementsMatch(t, []error{
+		factor3.RuleError{Rule: `self.min < self.max`, Paths: []string{"ranges.1.max", "ranges.1.min"}},
+		factor3.RuleError{Rule: `!self.enabled || self.cert_file != ""`, Paths: []string{"ranges.1.tls.cert_file", "ranges.1.tls.enabled"}},
+		factor3.RuleError{Rule: `self.min < self.max`, Paths: []string{"named.a.max", "named.a.min"}},
+	}, lerr.Errs)
+}
+
+func TestRegisterRuleInvalid(t *testing.T) {
+	type Config struct {
+		Name string `json:"name"`
+	}
+	factor3.RegisterRule[Config](`self.name +`)
+	_, _, _, err := bindTest(t, &Config{}, "")
+	var perr factor3.ParseError
+	require.ErrorAs(t, err, &perr)
+}
+
+type hooksTestServer struct {
+	Host string `json:"host"`
+	Port int    `json:"port"`
+	// Addr is derived from Host and Port in AfterLoad()
+	Addr string `json:"-"`
+}
+
+func (s *hooksTestServer) AfterLoad() error {
+	s.Addr = fmt.Sprintf("%s:%d", s.Host, s.Port)
+	return nil
+}
+
+func (s hooksTestServer) Validate() error {
+	if s.Host == "" {
+		return errors.New("host must be set")
+	}
+	return nil
+}
+
+func TestHooks(t *testing.T) {
+	type Config struct {
+		Server  hooksTestServer            `json:"server"`
+		Servers []hooksTestServer          `json:"servers"`
+		Tenants map[string]hooksTestServer `json:"tenants"`
+		Github  example.Github             `json:"github"`
+	}
+
+	var conf Config
+	loader, _, flagset, err := bindTest(t, &conf, `
+server:
+  host: localhost
+  port: 80
+servers:
+  - host: a
+    port: 1
+tenants:
+  acme:
+    host: b
+    port: 2
+github:
+  token: t
+  app:
+    installation_id: "12"
+`)
+	require.NoError(t, err, "factor3.Bind()")
+	require.NoError(t, flagset.Parse(nil))
+	require.NoError(t, loader.Load(), "factor3.Load()")
+	assert.Equal(t, "localhost:80", conf.Server.Addr)
+	assert.Equal(t, "a:1", conf.Servers[0].Addr)
+	assert.Equal(t, "b:2", conf.Tenants["acme"].Addr)
+	assert.Equal(t, int64(12), conf.Github.App.InstallationIDMustInt64())
+
+	t.Setenv("TEST_SERVER_HOST", "")
+	t.Setenv("TEST_SERVERS_0_HOST", "")
+	t.Setenv("TEST_TENANTS_ACME_HOST", "")
+	t.Setenv("TEST_GITHUB_APP_INSTALLATION_ID", "twelve")
+	err = loader.Load()
+	var lerr factor3.LoadError
+	require.ErrorAs(t, err, &lerr)
+	var paths []string
+	for _, e := range lerr.Errs {
+		var herr factor3.HookError
+		require.ErrorAs(t, e, &herr)
+		assert.Equal(t, "Validate", herr.Hook)
+		paths = append(paths, herr.Path)
+	}
+	assert.Equal(t, []string{"server", "servers[0]", "tenants.acme", "github.app"}, paths)
+}
+
+type HooksTestA struct{}
+
+func (HooksTestA) Validate() error { return errors.New("a") }
+
+type HooksTestB struct{}
+
+func (*HooksTestB) Validate() error { return errors.New("b") }
+
+// HooksTestAmbiguous has no Validate(), since both embedded structs declare it
+type HooksTestAmbiguous struct {
+	HooksTestA
+	HooksTestB
+}
+
+type hooksTestShadowed struct {
+	HooksTestA
+}
+
+func (hooksTestShadowed) Validate() error { return errors.New("shadowed") }
+
+type hooksTestPromoted struct {
+	*HooksTestB `json:"b"`
+}
+
+func TestEmbeddedHooks(t *testing.T) {
+	type Config struct {
+		Ambiguous HooksTestAmbiguous `json:"ambiguous"`
+		Shadowed  hooksTestShadowed  `json:"shadowed"`
+		Promoted  hooksTestPromoted  `json:"promoted"`
+	}
+
+	conf := Config{Promoted: hooksTestPromoted{&HooksTestB{}}}
+	loader, _, flagset, err := bindTest(t, &conf, "")
+	require.NoError(t, err, "factor3.Bind()")
+	require.NoError(t, flagset.Parse(nil))
+	var lerr factor3.LoadError
+	require.ErrorAs(t, loader.Load(), &lerr)
+	var got []string
+	for _, e := range lerr.Errs {
+		var herr factor3.HookError
+		require.ErrorAs(t, e, &herr)
+		got = append(got, herr.Path+": "+herr.Err.Error())
+	}
+	assert.Equal(t, []string{"ambiguous: a", "ambiguous: b", "shadowed: shadowed", "promoted: b"}, got)
+}
+
+type defaulterTestPool struct {
+	Workers int    `flag:"workers" json:"workers"`
+	Name    string `flag:"name" json:"name" default:"from-tag"`
+}
+
+func (p *defaulterTestPool) SetDefaults() {
+	p.Workers = runtime.NumCPU()
+	p.Name = "pool"
+}
+
+type defaulterTestConfig struct {
+	Pool  defaulterTestPool `flag:"pool" json:"pool"`
+	Other defaulterTestPool `flag:"other" json:"other"`
+	Host  string            `flag:"host" json:"host" default:"from-tag"`
+}
+
+func (c *defaulterTestConfig) SetDefaults() {
+	c.Other.Workers = 1
+	c.Host = "from-code"
+}
+
+func TestDefaulter(t *testing.T) {
+	var conf defaulterTestConfig
+	loader, viperInstance, flagset, err := bindTest(t, &conf, "other:\n  name: from-file\n")
+	require.NoError(t, err, "factor3.Bind()")
+	assert.Equal(t, strconv.Itoa(runtime.NumCPU()), flagset.Lookup("pool-workers").DefValue)
+	assert.Equal(t, "1", flagset.Lookup("other-workers").DefValue, "parents override nested defaults")
+	assert.Equal(t, "from-code", flagset.Lookup("host").DefValue, "SetDefaults() wins over the default tag")
+	assert.False(t, viperInstance.IsSet("pool.workers"), "SetDefaults() values are not stored in viper")
+	assert.False(t, viperInstance.IsSet("host"), "the default tag isn't stored in viper when SetDefaults() overrides it")
+
+	require.NoError(t, flagset.Parse([]string{"--pool-workers", "3"}))
+	require.NoError(t, loader.Load(), "factor3.Load()")
+	assert.Equal(t, 3, conf.Pool.Workers)
+	assert.Equal(t, "pool", conf.Pool.Name)
+	assert.Equal(t, 1, conf.Other.Workers)
+	assert.Equal(t, "from-file", conf.Other.Name)
+}
+
+type usageTestConfig struct {
+	Port    int    `flag:"port" json:"port" usage:"Port to listen on."`
+	Host    string `flag:"host" json:"host" desc:"Host to listen on"`
+	Name    string `flag:"name" json:"name"`
+	Verbose bool   `flag:"verbose" json:"verbose"`
+}
+
+func init() {
+	factor3.RegisterFieldDocs[usageTestConfig](map[string]string{
+		"Name": "Name of the service",
+	})
+}
+
+func TestFlagUsage(t *testing.T) {
+	var conf usageTestConfig
+	_, _, flagset, err := bindTest(t, &conf, "")
+	require.NoError(t, err, "factor3.Bind()")
+	assert.Equal(t, "Port to listen on (env TEST_PORT, config key port)", flagset.Lookup("port").Usage)
+	assert.Equal(t, "Host to listen on (env TEST_HOST, config key host)", flagset.Lookup("host").Usage)
+	assert.Equal(t, "Name of the service (env TEST_NAME, config key name)", flagset.Lookup("name").Usage)
+	assert.Equal(t, "(env TEST_VERBOSE, config key verbose)", flagset.Lookup("verbose").Usage)
+
+	// Bind() before InitializeViper()
+	viperInstance := factor3.NewViper(viper.New())
+	flagset = pflag.NewFlagSet(t.Name(), pflag.ContinueOnError)
+	_, err = factor3.Bind(&conf, viperInstance, flagset)
+	require.NoError(t, err, "factor3.Bind()")
+	assert.Equal(t, "Port to listen on (env PORT, config key port)", flagset.Lookup("port").Usage)
+	viperInstance.SetEnvPrefix("later")
+	assert.Equal(t, "Port to listen on (env LATER_PORT, config key port)", flagset.Lookup("port").Usage)
+
+	// factor3 doesn't set finalizers on the viper instance
+	v := viper.New()
+	runtime.SetFinalizer(v, func(*viper.Viper) {})
+	viperInstance = factor3.NewViper(v)
+	viperInstance.SetEnvPrefix("test")
+	_, err = factor3.Bind(&conf, viperInstance, pflag.NewFlagSet(t.Name(), pflag.ContinueOnError))
+	require.NoError(t, err, "factor3.Bind()")
+	runtime.SetFinalizer(v, nil)
+}
+
+func TestShortFlags(t *testing.T) {
+	type Config struct {
+		Number  int    `flag:"some-number" json:"some_number" short:"n"`
+		Verbose bool   `flag:"verbose" json:"verbose" short:"v"`
+		Name    string `flag:"name" json:"name"`
+	}
+
+	var conf Config
+	loader, _, flagset, err := bindTest(t, &conf, "")
+	require.NoError(t, err, "factor3.Bind()")
+	require.NoError(t, flagset.Parse([]string{"-n", "4", "-v"}))
+	require.NoError(t, loader.Load(), "factor3.Load()")
+	assert.Equal(t, 4, conf.Number)
+	assert.True(t, conf.Verbose)
+
+	type Collision struct {
+		Name    string `flag:"name" json:"name" short:"n"`
+		Network string `flag:"network" json:"network" short:"n"`
+	}
+	_, _, _, err = bindTest(t, &Collision{}, "")
+	var perr factor3.ParseError
+	require.ErrorAs(t, err, &perr)
+	assert.ErrorContains(t, err, "shorthand -n")
+
+	type TooLong struct {
+		Name string `flag:"name" json:"name" short:"nm"`
+	}
+	_, _, _, err = bindTest(t, &TooLong{}, "")
+	require.ErrorAs(t, err, &perr)
+
+	type Redefined struct {
+		Name  string `flag:"name" json:"name"`
+		Other string `flag:"name" json:"other"`
+	}
+	_, _, _, err = bindTest(t, &Redefined{}, "")
+	require.ErrorAs(t, err, &perr)
+}
+
+func TestCollectionFlags(t *testing.T) {
+	type Config struct {
+		Tags     []string          `flag:"tags" json:"tags"`
+		Ports    []int             `flag:"ports" json:"ports"`
+		Timeouts []time.Duration   `flag:"timeouts" json:"timeouts"`
+		Labels   map[string]string `flag:"labels" json:"labels"`
+		Quotas   map[string]int    `flag:"quotas" json:"quotas"`
+	}
+
+	var conf Config
+	loader, _, flagset, err := bindTest(t, &conf, `
+tags: [a, b]
+ports: [80]
+labels:
+  team: core
+quotas:
+  cpu: 1
+`)
+	require.NoError(t, err, "factor3.Bind()")
+	require.NoError(t, flagset.Parse(nil))
+	require.NoError(t, loader.Load(), "factor3.Load()")
+	assert.Equal(t, []string{"a", "b"}, conf.Tags)
+	assert.Equal(t, []int{80}, conf.Ports)
+	assert.Equal(t, map[string]string{"team": "core"}, conf.Labels)
+
+	require.NoError(t, flagset.Parse([]string{
+		"--tags", "c", "--tags", "d,e",
+		"--ports", "8080,8443",
+		"--timeouts", "1s,1m",
+		"--labels", "env=prod",
+		"--quotas", "cpu=2,mem=4",
+	}))
+	require.NoError(t, loader.Load(), "factor3.Load()")
+	assert.Equal(t, []string{"c", "d", "e"}, conf.Tags)
+	assert.Equal(t, []int{8080, 8443}, conf.Ports)
+	assert.Equal(t, []time.Duration{time.Second, time.Minute}, conf.Timeouts)
+	assert.Equal(t, map[string]string{"env": "prod"}, conf.Labels)
+	assert.Equal(t, map[string]int{"cpu": 2, "mem": 4}, conf.Quotas)
+}
+
+func TestWellKnownTypes(t *testing.T) {
+	type Config struct {
+		Timeout  time.Duration  `flag:"timeout" json:"timeout" default:"30s"`
+		Since    time.Time      `flag:"since" json:"since"`
+		IP       net.IP         `flag:"ip" json:"ip"`
+		Subnet   net.IPNet      `flag:"subnet" json:"subnet"`
+		Endpoint *url.URL       `flag:"endpoint" json:"endpoint"`
+		Pattern  *regexp.Regexp `flag:"pattern" json:"pattern"`
+		Retries  uint           `json:"retries"`
+		Ratio    float64        `json:"ratio"`
+	}
+
+	var conf Config
+	loader, _, flagset, err := bindTest(t, &conf, `
+since: "2024-01-02T03:04:05Z"
+ip: 10.0.0.1
+subnet: 10.0.0.0/8
+endpoint: https://example.com/api
+pattern: ^a+$
+`)
+	require.NoError(t, err, "factor3.Bind()")
+	assert.Equal(t, "30s", flagset.Lookup("timeout").DefValue)
+	assert.Equal(t, "duration", flagset.Lookup("timeout").Value.Type())
+
+	require.NoError(t, flagset.Parse(nil))
+	require.NoError(t, loader.Load(), "factor3.Load()")
+	assert.Equal(t, 30*time.Second, conf.Timeout)
+	assert.Equal(t, time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC), conf.Since.UTC())
+	assert.Equal(t, "10.0.0.1", conf.IP.String())
+	assert.Equal(t, "10.0.0.0/8", conf.Subnet.String())
+	assert.Equal(t, "https://example.com/api", conf.Endpoint.String())
+	assert.True(t, conf.Pattern.MatchString("aaa"))
+
+	t.Setenv("TEST_TIMEOUT", "1m")
+	t.Setenv("TEST_RETRIES", "3")
+	t.Setenv("TEST_RATIO", "0.5")
+	t.Setenv("TEST_SUBNET", "192.168.0.0/16")
+	require.NoError(t, flagset.Parse([]string{
+		"--since", "2025-01-01T00:00:00Z",
+		"--ip", "::1",
+		"--endpoint", "http://localhost:8080",
+		"--pattern", "^b+$",
+	}))
+	require.NoError(t, loader.Load(), "factor3.Load()")
+	assert.Equal(t, time.Minute, conf.Timeout)
+	assert.Equal(t, uint(3), conf.Retries)
+	assert.Equal(t, 0.5, conf.Ratio)
+	assert.Equal(t, "192.168.0.0/16", conf.Subnet.String())
+	assert.Equal(t, 2025, conf.Since.Year())
+	assert.Equal(t, "::1", conf.IP.String())
+	assert.Equal(t, "localhost:8080", conf.Endpoint.Host)
+	assert.True(t, conf.Pattern.MatchString("bb"))
+
+	require.Error(t, flagset.Parse([]string{"--timeout", "soon"}), "invalid flag values fail when parsing flags")
+	t.Setenv("TEST_SUBNET", "not-a-subnet")
+	var lerr factor3.LoadError
+	require.ErrorAs(t, loader.Load(), &lerr)
+}
+
+// textTestLevel is an int in Go, but text in config files, env and flags
+type textTestLevel int
+
+func (l *textTestLevel) UnmarshalText(text []byte) error {
+	i := slices.Index([]string{"debug", "info", "warn"}, string(text))
+	if i < 0 {
+		return fmt.Errorf("unknown level %q", text)
+	}
+	*l = textTestLevel(i)
+	return nil
+}
+
+func (l textTestLevel) MarshalText() ([]byte, error) {
+	return []byte([]string{"debug", "info", "warn"}[l]), nil
+}
+
+// textTestRegion is a struct that implements pflag.Value
+type textTestRegion struct {
+	Cloud, Name string
+}
+
+func (r *textTestRegion) String() string {
+	if r.Cloud == "" {
+		return ""
+	}
+	return r.Cloud + "/" + r.Name
+}
+func (r *textTestRegion) Type() string { return "region" }
+func (r *textTestRegion) Set(s string) error {
+	cloud, name, ok := strings.Cut(s, "/")
+	if !ok {
+		return fmt.Errorf("region %q must be formatted as cloud/name", s)
+	}
+	*r = textTestRegion{Cloud: cloud, Name: name}
+	return nil
+}
+
+func TestTextTypes(t *testing.T) {
+	type Config struct {
+		Level    textTestLevel        `flag:"level" json:"level" default:"info"`
+		Region   textTestRegion       `flag:"region" json:"region"`
+		Password factor3.SecretString `flag:"password" json:"password"`
+		Backup   *textTestRegion      `json:"backup"`
+	}
+
+	var conf Config
+	loader, _, flagset, err := bindTest(t, &conf, `
+region: aws/us-east-1
+password: from-file
+`)
+	require.NoError(t, err, "factor3.Bind()")
+	assert.Equal(t, "info", flagset.Lookup("level").DefValue)
+	assert.Equal(t, "textTestLevel", flagset.Lookup("level").Value.Type())
+	assert.Equal(t, "region", flagset.Lookup("region").Value.Type())
+
+	require.NoError(t, flagset.Parse(nil))
+	require.NoError(t, loader.Load(), "factor3.Load()")
+	assert.Equal(t, textTestLevel(1), conf.Level)
+	assert.Equal(t, textTestRegion{Cloud: "aws", Name: "us-east-1"}, conf.Region)
+	assert.Equal(t, factor3.SecretString("from-file"), conf.Password)
+
+	t.Setenv("TEST_LEVEL", "warn")
+	t.Setenv("TEST_BACKUP", "gcp/europe-west1")
+	require.NoError(t, flagset.Parse([]string{"--region", "azure/westeurope", "--password", "from-flag"}))
+	require.NoError(t, loader.Load(), "factor3.Load()")
+	assert.Equal(t, textTestLevel(2), conf.Level)
+	assert.Equal(t, textTestRegion{Cloud: "azure", Name: "westeurope"}, conf.Region)
+	assert.Equal(t, factor3.SecretString("from-flag"), conf.Password, "flag values are not masked")
+	assert.Equal(t, &textTestRegion{Cloud: "gcp", Name: "europe-west1"}, conf.Backup)
+
+	t.Setenv("TEST_LEVEL", "loud")
+	var lerr factor3.LoadError
+	require.ErrorAs(t, loader.Load(), &lerr)
+}
+
+func init() {
+	// slog.Level already implements encoding.TextUnmarshaler, but registered decoders take precedence
+	factor3.RegisterDecoder(func(raw any) (slog.Level, error) {
+		var l slog.Level
+		if raw == "verbose" {
+			return slog.LevelDebug, nil
+		}
+		err := l.UnmarshalText([]byte(fmt.Sprint(raw)))
+		return l, err
+	})
+	factor3.RegisterDecoder(func(raw any) (big.Int, error) {
+		var i big.Int
+		if _, ok := i.SetString(fmt.Sprint(raw), 10); !ok {
+			return i, fmt.Errorf("%v is not an integer", raw)
+		}
+		return i, nil
+	})
+}
+
+func TestRegisterDecoder(t *testing.T) {
+	type Config struct {
+		Level  slog.Level            `flag:"level" json:"level"`
+		Levels []slog.Level          `json:"levels"`
+		ByName map[string]slog.Level `json:"by_name"`
+		Big    *big.Int              `flag:"big" json:"big"`
+	}
+
+	var conf Config
+	loader, _, flagset, err := bindTest(t, &conf, `
+level: verbose
+levels: [verbose, warn]
+by_name:
+  db: error
+big: 12345678901234567890
+`)
+	require.NoError(t, err, "factor3.Bind()")
+	require.NoError(t, flagset.Parse(nil))
+	require.NoError(t, loader.Load(), "factor3.Load()")
+	assert.Equal(t, slog.LevelDebug, conf.Level)
+	assert.Equal(t, []slog.Level{slog.LevelDebug, slog.LevelWarn}, conf.Levels)
+	assert.Equal(t, map[string]slog.Level{"db": slog.LevelError}, conf.ByName)
+	assert.Equal(t, "12345678901234567890", conf.Big.String())
+
+	t.Setenv("TEST_LEVELS", "info,verbose")
+	require.NoError(t, flagset.Parse([]string{"--level", "WARN", "--big", "98765432109876543210"}))
+	require.NoError(t, loader.Load(), "factor3.Load()")
+	assert.Equal(t, slog.LevelWarn, conf.Level)
+	assert.Equal(t, []slog.Level{slog.LevelInfo, slog.LevelDebug}, conf.Levels)
+	assert.Equal(t, "98765432109876543210", conf.Big.String())
+
+	t.Setenv("TEST_LEVELS", "loud")
+	var lerr factor3.LoadError
+	require.ErrorAs(t, loader.Load(), &lerr)
+}
+
+func TestByteSizeAndPercent(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want factor3.ByteSize
+		str  string
+	}{
+		{"0", 0, "0B"},
+		{"512", 512, "512B"},
+		{"10MiB", 10 * factor3.MiB, "10MiB"},
+		{"10 mib", 10 * factor3.MiB, "10MiB"},
+		{"1.5GB", 1500 * factor3.MB, "1500MB"},
+		{"1.5GiB", 1536 * factor3.MiB, "1536MiB"},
+		{"2KB", 2 * factor3.KB, "2KB"},
+	} {
+		got, err := factor3.ParseByteSize(tc.in)
+		require.NoError(t, err, tc.in)
+		assert.Equal(t, tc.want, got, tc.in)
+		assert.Equal(t, tc.str, got.String(), tc.in)
+	}
+	for _, in := range []string{"", "MB", "10XB", "-1MB", "20EiB"} {
+		_, err := factor3.ParseByteSize(in)
+		assert.Error(t, err, in)
+	}
+	for _, in := range []string{"", "%", "NaN", "Inf%", "-inf"} {
+		_, err := factor3.ParsePercent(in)
+		assert.Error(t, err, in)
+	}
+
+	type Config struct {
+		Buffer    factor3.ByteSize `flag:"buffer" json:"buffer" default:"4KiB"`
+		MaxUpload factor3.ByteSize `json:"max_upload" validate:"max=1GB"`
+		Sample    factor3.Percent  `flag:"sample" json:"sample" validate:"max=100"`
+		Limit     factor3.Percent  `json:"limit"`
+	}
+
+	var conf Config
+	loader, _, flagset, err := bindTest(t, &conf, `
+max_upload: 100MB
+sample: 12.5%
+limit: 80
+`)
+	require.NoError(t, err, "factor3.Bind()")
+	assert.Equal(t, "4KiB", flagset.Lookup("buffer").DefValue)
+	require.NoError(t, flagset.Parse(nil))
+	require.NoError(t, loader.Load(), "factor3.Load()")
+	assert.Equal(t, 4*factor3.KiB, conf.Buffer)
+	assert.Equal(t, 100*factor3.MB, conf.MaxUpload)
+	assert.Equal(t, factor3.Percent(12.5), conf.Sample)
+	assert.Equal(t, 0.8, conf.Limit.Fraction())
+
+	t.Setenv("TEST_MAX_UPLOAD", "512MiB")
+	require.NoError(t, flagset.Parse([]string{"--buffer", "1MiB", "--sample", "50%"}))
+	require.NoError(t, loader.Load(), "factor3.Load()")
+	assert.Equal(t, factor3.MiB, conf.Buffer)
+	assert.Equal(t, 512*factor3.MiB, conf.MaxUpload)
+	assert.Equal(t, factor3.Percent(50), conf.Sample)
+
+	b, err := json.Marshal(conf)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"buffer":"1MiB","max_upload":"512MiB","sample":"50%","limit":"80%"}`, string(b))
+
+	t.Setenv("TEST_MAX_UPLOAD", "2GB")
+	var lerr factor3.LoadError
+	require.ErrorAs(t, loader.Load(), &lerr)
+
+	t.Setenv("TEST_MAX_UPLOAD", "")
+	require.ErrorAs(t, loader.Load(), &lerr, "an empty env var is not a zero byte size")
+}
+
+func TestNaming(t *testing.T) {
+	for _, tc := range []struct {
+		in, snake, kebab, camel string
+	}{
+		{"Name", "name", "name", "name"},
+		{"LongerString", "longer_string", "longer-string", "longerString"},
+		{"InstallationID", "installation_id", "installation-id", "installationId"},
+		{"HTTPServer", "http_server", "http-server", "httpServer"},
+		{"V2Api", "v2_api", "v2-api", "v2Api"},
+	} {
+		assert.Equal(t, tc.snake, factor3.SnakeCase(tc.in), tc.in)
+		assert.Equal(t, tc.kebab, factor3.KebabCase(tc.in), tc.in)
+		assert.Equal(t, tc.camel, factor3.CamelCase(tc.in), tc.in)
+	}
+
+	type Server struct {
+		ListenAddr string
+		MaxConns   int `flag:"conns"`
+	}
+	type Config struct {
+		ClientID string `validate:"min=3"`
+		Secret   string `json:"client_secret" flag:""`
+		Server   Server
+	}
+	factor3.RegisterRule[Config](`self.server.max_conns > 0`)
+
+	var conf Config
+	loader, _, flagset, err := bindTest(t, &conf, `
+client_id: abc
+client_secret: s3cr3t
+server:
+  max_conns: 10
+`, factor3.WithNaming(factor3.SnakeCase), factor3.WithAutoFlags())
+	require.NoError(t, err, "factor3.Bind()")
+	assert.NotNil(t, flagset.Lookup("client_id"))
+	assert.NotNil(t, flagset.Lookup("server-listen_addr"))
+	assert.NotNil(t, flagset.Lookup("server-conns"))
+	assert.Nil(t, flagset.Lookup("secret"))
+
+	t.Setenv("TEST_SERVER_LISTEN_ADDR", ":8080")
+	require.NoError(t, flagset.Parse([]string{"--server-conns", "20"}))
+	require.NoError(t, loader.Load(), "factor3.Load()")
+	assert.Equal(t, Config{
+		ClientID: "abc",
+		Secret:   "s3cr3t",
+		Server:   Server{ListenAddr: ":8080", MaxConns: 20},
+	}, conf)
+
+	require.NoError(t, flagset.Parse([]string{"--server-conns", "0"}))
+	var lerr factor3.LoadError
+	require.ErrorAs(t, loader.Load(), &lerr)
+	var rerr factor3.RuleError
+	require.ErrorAs(t, lerr.Errs[0], &rerr)
+	assert.Equal(t, []string{"server.max_conns"}, rerr.Paths)
+}
+
+func TestUntaggedFieldFlags(t *testing.T) {
+	type TLS struct {
+		Mode string `json:"mode"`
+	}
+	type Database struct {
+		Host string `flag:"host" json:"host"`
+		Port int    `json:"port"`
+		TLS  TLS    `json:"tls"`
+	}
+	type Config struct {
+		DB Database `flag:"db" json:"db"`
+	}
+
+	var conf Config
+	_, _, flagset, err := bindTest(t, &conf, "")
+	require.NoError(t, err, "factor3.Bind()")
+	assert.NotNil(t, flagset.Lookup("db-host"))
+	assert.Nil(t, flagset.Lookup("db"), "fields without a flag tag don't get the flag of the struct above them")
+
+	conf = Config{}
+	_, _, flagset, err = bindTest(t, &conf, "", factor3.WithAutoFlags())
+	require.NoError(t, err, "factor3.Bind()")
+	assert.NotNil(t, flagset.Lookup("db-port"))
+	assert.NotNil(t, flagset.Lookup("db-tls-mode"))
+}
+
+func TestEnvTag(t *testing.T) {
+	type Config struct {
+		Token string `flag:"token" json:"token" env:"GITHUB_TOKEN, GH_TOKEN" required:"true"`
+		Host  string `json:"host" env:"LEGACY_HOST"`
+	}
+
+	var conf Config
+	loader, _, flagset, err := bindTest(t, &conf, "")
+	require.NoError(t, err, "factor3.Bind()")
+	assert.Equal(t, "(env TEST_TOKEN or GITHUB_TOKEN or GH_TOKEN, config key token)", flagset.Lookup("token").Usage)
+	require.NoError(t, flagset.Parse(nil))
+
+	var lerr factor3.LoadError
+	require.ErrorAs(t, loader.Load(), &lerr)
+	var merr factor3.MissingValueError
+	require.ErrorAs(t, lerr.Errs[0], &merr)
+	assert.Equal(t, "TEST_TOKEN or GITHUB_TOKEN or GH_TOKEN", merr.Env)
+
+	t.Setenv("GH_TOKEN", "gh")
+	t.Setenv("LEGACY_HOST", "old.example.com")
+	require.NoError(t, loader.Load(), "factor3.Load()")
+	assert.Equal(t, Config{Token: "gh", Host: "old.example.com"}, conf)
+
+	t.Setenv("GITHUB_TOKEN", "github")
+	t.Setenv("TEST_HOST", "new.example.com")
+	require.NoError(t, loader.Load(), "factor3.Load()")
+	assert.Equal(t, Config{Token: "github", Host: "new.example.com"}, conf)
+
+	var bad struct {
+		Token string `env:"A,,B"`
+	}
+	_, _, _, err = bindTest(t, &bad, "")
+	assert.ErrorContains(t, err, "invalid env tag")
+}
+
+func TestSeparators(t *testing.T) {
+	type Log struct {
+		Level        string `flag:"level" json:"level"`
+		LongerString string `flag:"longer-string" json:"longer_string"`
+	}
+	type Config struct {
+		Log Log `flag:"log" json:"log"`
+	}
+
+	var conf Config
+	flagset := pflag.NewFlagSet(t.Name(), pflag.ContinueOnError)
+	viperInstance := factor3.NewViper(viper.New())
+	viperInstance.SetEnvPrefix("test")
+	require.NoError(t, viperInstance.SetEnvSeparator("__"))
+	loader, err := factor3.Bind(&conf, viperInstance, flagset, factor3.WithFlagSeparator("."))
+	require.NoError(t, err, "factor3.Bind()")
+	require.NotNil(t, flagset.Lookup("log.level"))
+	assert.Equal(t, "(env TEST_LOG__LONGER_STRING, config key log.longer_string)", flagset.Lookup("log.longer-string").Usage)
+
+	tFileSys := afero.NewMemMapFs()
+	require.NoError(t, afero.WriteFile(tFileSys, "config.yaml", nil, 0o644))
+	viperInstance.SetFs(tFileSys)
+	require.NoError(t, factor3.InitializeViper(factor3.InitArgs{
+		Viper:        viperInstance,
+		ProgramName:  "test",
+		CfgFile:      "config.yaml",
+		EnvSeparator: "__",
+	}), "factor3.InitializeViper()")
+
+	t.Setenv("TEST_LOG__LONGER_STRING", "from-env")
+	t.Setenv("TEST_LOG_LONGER_STRING", "ignored")
+	require.NoError(t, flagset.Parse([]string{"--log.level", "debug"}))
+	require.NoError(t, loader.Load(), "factor3.Load()")
+	assert.Equal(t, Log{Level: "debug", LongerString: "from-env"}, conf.Log)
+}
+
+func TestSeparatorAfterBind(t *testing.T) {
+	type TLS struct {
+		Mode string `json:"mode"`
+	}
+	type Database struct {
+		SSL TLS `json:"ssl"`
+	}
+	type Config struct {
+		DB Database `flag:"db" json:"db" envPrefix:"PG"`
+	}
+
+	var conf Config
+	viperInstance := factor3.NewViper(viper.New())
+	loader, err := factor3.Bind(&conf, viperInstance, pflag.NewFlagSet(t.Name(), pflag.ContinueOnError))
+	require.NoError(t, err, "factor3.Bind()")
+
+	tFileSys := afero.NewMemMapFs()
+	require.NoError(t, afero.WriteFile(tFileSys, "config.yaml", nil, 0o644))
+	viperInstance.SetFs(tFileSys)
+	require.NoError(t, factor3.InitializeViper(factor3.InitArgs{
+		Viper:        viperInstance,
+		ProgramName:  "test",
+		CfgFile:      "config.yaml",
+		EnvSeparator: "__",
+	}), "factor3.InitializeViper()")
+
+	t.Setenv("PGSSL_MODE", "stale")
+	t.Setenv("PGSSL__MODE", "require")
+	require.NoError(t, loader.Load(), "factor3.Load()")
+	assert.Equal(t, "require", conf.DB.SSL.Mode)
+
+	assert.Error(t, viperInstance.SetEnvSeparator("_"), "env vars are bound with the separator once loaded")
+	assert.NoError(t, viperInstance.SetEnvSeparator("__"))
+}
+
+func TestEnvPrefixTag(t *testing.T) {
+	type TLS struct {
+		Mode string `flag:"mode" json:"mode"`
+	}
+	type Database struct {
+		Host string `flag:"host" json:"host"`
+		Port int    `flag:"port" json:"port" env:"DATABASE_PORT"`
+		SSL  TLS    `json:"ssl"`
+	}
+	type Config struct {
+		DB    Database  `flag:"db" json:"db" envPrefix:"PG"`
+		Cache Database  `json:"cache" envPrefix:"REDIS_"`
+		Queue *Database `flag:"queue" json:"queue" envPrefix:"AMQP_"`
+		Name  string    `json:"name"`
+	}
+
+	var conf Config
+	loader, _, flagset, err := bindTest(t, &conf, "")
+	require.NoError(t, err, "factor3.Bind()")
+	assert.Equal(t, "(env TEST_DB_HOST or PGHOST, config key db.host)", flagset.Lookup("db-host").Usage)
+	require.NoError(t, flagset.Parse(nil))
+
+	t.Setenv("PGHOST", "pg.local")
+	t.Setenv("PGSSL_MODE", "require")
+	t.Setenv("DATABASE_PORT", "5432")
+	t.Setenv("REDIS_HOST", "redis.local")
+	t.Setenv("TEST_NAME", "svc")
+	t.Setenv("TEST_QUEUE_HOST", "amqp.local")
+	require.NoError(t, loader.Load(), "factor3.Load()")
+	assert.Equal(t, Config{
+		DB:    Database{Host: "pg.local", Port: 5432, SSL: TLS{Mode: "require"}},
+		Cache: Database{Host: "redis.local", Port: 5432},
+		Queue: &Database{Host: "amqp.local", Port: 5432},
+		Name:  "svc",
+	}, conf)
+}
+
+func TestSkippedFields(t *testing.T) {
+	type Config struct {
+		Name     string `flag:"name" json:"name"`
+		internal string
+		mu       sync.Mutex
+		OnChange func()         `factor3:"-"`
+		Cache    map[string]int `json:"-"`
+	}
+
+	var conf Config
+	conf.internal = "kept"
+	loader, _, flagset, err := bindTest(t, &conf, "name: n\ncache:\n  a: 1\n")
+	require.NoError(t, err, "factor3.Bind()")
+	require.NoError(t, flagset.Parse(nil))
+	require.NoError(t, loader.Load(), "factor3.Load()")
+	assert.Equal(t, "n", conf.Name)
+	assert.Equal(t, "kept", conf.internal)
+	assert.Nil(t, conf.Cache)
+
+	for name, into := range map[string]any{
+		"chan":  &struct{ C chan int }{},
+		"func":  &struct{ F func() }{},
+		"slice": &struct{ S []func() }{},
+		"nested": &struct {
+			M map[string]struct{ C complex128 }
+		}{},
+		"interface": &struct{ I fmt.Stringer }{},
+	} {
+		_, _, _, err := bindTest(t, into, "")
+		var perr factor3.ParseError
+		require.ErrorAs(t, err, &perr, name)
+		assert.ErrorContains(t, err, "unsupported type", name)
+	}
+}
+
+type embeddedBase struct {
+	Name  string `flag:"name" json:"name"`
+	Level string `json:"level"`
+}
+
+type EmbeddedHTTP struct {
+	Port int `flag:"port" json:"port"`
+}
+
+func TestEmbeddedStructs(t *testing.T) {
+	type Meta struct {
+		Owner string `json:"owner"`
+	}
+	type Config struct {
+		embeddedBase
+		*EmbeddedHTTP `flag:"http"`
+		Meta          `factor3:"nested"`
+		Level         int `json:"level"`
+	}
+	factor3.RegisterRule[Config](`self.port > 0 && self.name != ""`)
+
+	var conf Config
+	loader, _, flagset, err := bindTest(t, &conf, `
+name: svc
+level: 3
+port: 80
+meta:
+  owner: me
+`)
+	require.NoError(t, err, "factor3.Bind()")
+	assert.NotNil(t, flagset.Lookup("name"))
+	assert.NotNil(t, flagset.Lookup("http-port"))
+
+	t.Setenv("TEST_META_OWNER", "you")
+	require.NoError(t, flagset.Parse([]string{"--http-port", "8080"}))
+	require.NoError(t, loader.Load(), "factor3.Load()")
+	assert.Equal(t, "svc", conf.Name)
+	assert.Equal(t, "", conf.embeddedBase.Level)
+	assert.Equal(t, 3, conf.Level)
+	assert.Equal(t, 8080, conf.Port)
+	assert.Equal(t, "you", conf.Owner)
+
+	require.NoError(t, flagset.Parse([]string{"--http-port", "0"}))
+	var lerr factor3.LoadError
+	require.ErrorAs(t, loader.Load(), &lerr)
+	var rerr factor3.RuleError
+	require.ErrorAs(t, lerr.Errs[0], &rerr)
+	assert.Equal(t, []string{"name", "port"}, rerr.Paths)
+}
+
+func TestOptionalPointers(t *testing.T) {
+	type Client struct {
+		CA string `flag:"ca" json:"ca"`
+	}
+	type TLS struct {
+		Cert   string  `flag:"cert" json:"cert" required:"true"`
+		MinVer string  `flag:"min-version" json:"min_version" default:"1.2"`
+		Client *Client `json:"client"`
+	}
+	type Config struct {
+		TLS     *TLS           `flag:"tls" json:"tls"`
+		Verbose *bool          `flag:"verbose" json:"verbose"`
+		Timeout *time.Duration `json:"timeout"`
+		Limit   *int           `json:"limit"`
+	}
+
+	limit := 5
+	conf := Config{Limit: &limit}
+	loader, _, flagset, err := bindTest(t, &conf, "")
+	require.NoError(t, err, "factor3.Bind()")
+	assert.Nil(t, conf.TLS)
+	assert.Nil(t, conf.Verbose)
+
+	require.NoError(t, flagset.Parse(nil))
+	require.NoError(t, loader.Load(), "factor3.Load()")
+	assert.Nil(t, conf.TLS)
+	assert.Nil(t, conf.Verbose)
+	assert.Nil(t, conf.Timeout)
+	require.NotNil(t, conf.Limit)
+	assert.Equal(t, 5, *conf.Limit)
+
+	t.Setenv("TEST_TIMEOUT", "1m")
+	require.NoError(t, flagset.Parse([]string{"--verbose=false", "--tls-cert", "cert.pem"}))
+	require.NoError(t, loader.Load(), "factor3.Load()")
+	require.NotNil(t, conf.Verbose)
+	assert.False(t, *conf.Verbose)
+	require.NotNil(t, conf.Timeout)
+	assert.Equal(t, time.Minute, *conf.Timeout)
+	require.NotNil(t, conf.TLS)
+	assert.Equal(t, TLS{Cert: "cert.pem", MinVer: "1.2"}, *conf.TLS)
+
+	var conf2 Config
+	loader, _, flagset, err = bindTest(t, &conf2, "tls:\n  client:\n    ca: ca.pem\n")
+	require.NoError(t, err, "factor3.Bind()")
+	require.NoError(t, flagset.Parse(nil))
+	var lerr factor3.LoadError
+	require.ErrorAs(t, loader.Load(), &lerr)
+	var merr factor3.MissingValueError
+	require.ErrorAs(t, lerr.Errs[0], &merr)
+	assert.Equal(t, "tls.cert", merr.Path)
+	assert.Nil(t, conf2.TLS)
+}
+
+func TestSliceOfStructs(t *testing.T) {
+	type Upstream struct {
+		Host    string `flag:"host" json:"host"`
+		Port    int    `flag:"port" json:"port" default:"80"`
+		Enabled bool   `flag:"enabled" json:"enabled"`
+	}
+	type Config struct {
+		Upstreams []Upstream `flag:"upstreams" json:"upstreams" flagElements:"3"`
+	}
+
+	var conf Config
+	loader, _, flagset, err := bindTest(t, &conf, `
+upstreams:
+  - host: a.local
+    port: 8080
+  - host: b.local
+`)
+	require.NoError(t, err, "factor3.Bind()")
+	assert.NotNil(t, flagset.Lookup("upstreams-2-host"))
+	assert.Nil(t, flagset.Lookup("upstreams-3-host"))
+	assert.Equal(t, "(env TEST_UPSTREAMS_1_PORT, config key upstreams.1.port)", flagset.Lookup("upstreams-1-port").Usage)
+
+	t.Setenv("TEST_UPSTREAMS_1_PORT", "9090")
+	t.Setenv("TEST_UPSTREAMS_2_HOST", "c.local")
+	require.NoError(t, flagset.Parse([]string{"--upstreams-0-host", "flag.local", "--upstreams-2-enabled"}))
+	require.NoError(t, loader.Load(), "factor3.Load()")
+	assert.Equal(t, []Upstream{
+		{Host: "flag.local", Port: 8080},
+		{Host: "b.local", Port: 9090},
+		{Host: "c.local", Port: 80, Enabled: true},
+	}, conf.Upstreams)
+
+	t.Setenv("TEST_UPSTREAMS", `[{"host":"json.local","port":1}]`)
+	require.NoError(t, loader.Load(), "factor3.Load()")
+	assert.Equal(t, []Upstream{
+		{Host: "flag.local", Port: 1},
+		{Host: "", Port: 9090},
+		{Host: "c.local", Port: 80, Enabled: true},
+	}, conf.Upstreams)
+
+	t.Setenv("TEST_UPSTREAMS_0_PORT", "not-a-port")
+	var lerr factor3.LoadError
+	require.ErrorAs(t, loader.Load(), &lerr)
+	assert.ErrorContains(t, lerr, "upstreams.0")
+
+	t.Setenv("TEST_UPSTREAMS_0_PORT", "1")
+	t.Setenv("TEST_UPSTREAMS_5000000_HOST", "far.local")
+	require.ErrorAs(t, loader.Load(), &lerr)
+	assert.ErrorContains(t, lerr, "index 5000000 is out of range, the slice has 3 elements")
+	assert.Len(t, conf.Upstreams, 3)
+}
+
+func TestElementChecks(t *testing.T) {
+	type Upstream struct {
+		Host string `flag:"host" json:"host" required:"true"`
+		Port int    `flag:"port" json:"port" validate:"min=1"`
+	}
+	type Config struct {
+		Upstreams []Upstream          `flag:"upstreams" json:"upstreams" validate:"max=1000"`
+		Tenants   map[string]Upstream `json:"tenants"`
+	}
+
+	var conf Config
+	loader, _, flagset, err := bindTest(t, &conf, `
+upstreams:
+  - host: a
+  - port: -1
+tenants:
+  acme:
+    host: b
+    port: -2
+`)
+	require.NoError(t, err, "factor3.Bind()")
+	assert.Nil(t, flagset.Lookup("upstreams-0-host"), "flags of elements are opt-in")
+	require.NoError(t, flagset.Parse(nil))
+
+	var lerr factor3.LoadError
+	require.ErrorAs(t, loader.Load(), &lerr)
+	var got []string
+	for _, e := range lerr.Errs {
+		var merr factor3.MissingValueError
+		var ferr factor3.FieldError
+		switch {
+		case errors.As(e, &merr):
+			got = append(got, merr.Path+" missing, env "+merr.Env)
+		case errors.As(e, &ferr):
+			got = append(got, ferr.Path+" "+ferr.Rule)
+		default:
+			t.Errorf("unexpected error %v", e)
+		}
+	}
+	assert.ElementsMatch(t, []string{
+		"upstreams.1.host missing, env TEST_UPSTREAMS_1_HOST",
+		"upstreams.1.port min=1",
+		"tenants.acme.port min=1",
+	}, got)
+}
+
+func TestMapOfStructs(t *testing.T) {
+	type Tenant struct {
+		Quota    int    `json:"quota" default:"10"`
+		MaxQuota int    `json:"max_quota"`
+		Plan     string `json:"plan"`
+	}
+	type Config struct {
+		Tenants      map[string]Tenant `json:"tenants"`
+		TenantsLimit int               `json:"tenants_limit"`
+		// TEST_TENANTS_DEFAULT_QUOTA would also set quota of the "default" tenant
+		TenantsDefaultQuota int `json:"tenants_default_quota"`
+	}
+
+	var conf Config
+	loader, _, flagset, err := bindTest(t, &conf, `
+tenants:
+  acme:
+    quota: 5
+    plan: pro
+  Globex:
+    plan: free
+`)
+	require.NoError(t, err, "factor3.Bind()")
+	require.NoError(t, flagset.Parse(nil))
+
+	t.Setenv("TEST_TENANTS_ACME_QUOTA", "50")
+	t.Setenv("TEST_TENANTS_GLOBEX_QUOTA", "20")
+	t.Setenv("TEST_TENANTS_NEW_CO_MAX_QUOTA", "7")
+	t.Setenv("TEST_TENANTS_JSON", `{"plan":"free"}`)
+	t.Setenv("TEST_TENANTS_LIMIT", "5")
+	t.Setenv("TEST_TENANTS_DEFAULT_QUOTA", "3")
+	t.Setenv("TEST_TENANTS_UNRELATED", "not json")
+	require.NoError(t, loader.Load(), "factor3.Load()")
+	assert.Equal(t, map[string]Tenant{
+		"acme":   {Quota: 50, Plan: "pro"},
+		"Globex": {Quota: 20, Plan: "free"},
+		"new_co": {Quota: 10, MaxQuota: 7},
+		"json":   {Plan: "free"},
+	}, conf.Tenants, "existing keys keep their case, new keys are lower case")
+	assert.Equal(t, 5, conf.TenantsLimit)
+	assert.Equal(t, 3, conf.TenantsDefaultQuota)
+
+	t.Setenv("TEST_TENANTS_ACME_QUOTA", "lots")
+	var lerr factor3.LoadError
+	require.ErrorAs(t, loader.Load(), &lerr)
+	assert.ErrorContains(t, lerr, "tenants.ACME")
+}
+
+func TestMapKeyCase(t *testing.T) {
+	type Route struct {
+		Headers map[string]string `json:"headers"`
+	}
+	type Config struct {
+		Headers map[string]string `json:"headers"`
+		Labels  map[string]int    `json:"labels"`
+		Routes  []Route           `json:"routes"`
+		Nested  struct {
+			Tags map[string][]string `json:"tags"`
+		} `json:"Nested"`
+	}
+
+	var conf Config
+	loader, _, flagset, err := bindTest(t, &conf, `
+Headers:
+  X-Request-ID: abc
+  Accept: text/plain
+labels:
+  Team: 1
+routes:
+  - headers:
+      X-Route: r
+nested:
+  tags:
+    MixedCase: [a, b]
+`)
+	require.NoError(t, err, "factor3.Bind()")
+	require.NoError(t, flagset.Parse(nil))
+	require.NoError(t, loader.Load(), "factor3.Load()")
+	assert.Equal(t, map[string]string{"X-Request-ID": "abc", "Accept": "text/plain"}, conf.Headers)
+	assert.Equal(t, map[string]int{"Team": 1}, conf.Labels)
+	assert.Equal(t, []Route{{Headers: map[string]string{"X-Route": "r"}}}, conf.Routes)
+	assert.Equal(t, map[string][]string{"MixedCase": {"a", "b"}}, conf.Nested.Tags)
+
+	t.Setenv("TEST_LABELS", "Other=2")
+	require.NoError(t, loader.Load(), "factor3.Load()")
+	assert.Equal(t, map[string]int{"Other": 2}, conf.Labels)
+}
+
+func TestMapKeyCaseReload(t *testing.T) {
+	type Config struct {
+		Headers map[string]string `json:"headers"`
+	}
+
+	dir := t.TempDir()
+	cfgFile := filepath.Join(dir, "config.yaml")
+	require.NoError(t, os.WriteFile(cfgFile, []byte("headers:\n  X-Request-ID: a\n"), 0o644))
+	t.Setenv("XDG_CONFIG_HOME", dir)
+
+	var conf Config
+	viperInstance := factor3.NewViper(viper.New())
+	require.NoError(t, factor3.InitializeViper(factor3.InitArgs{
+		Viper:       viperInstance,
+		ProgramName: "test",
+	}), "factor3.InitializeViper()")
+	flagset := pflag.NewFlagSet(t.Name(), pflag.ContinueOnError)
+	loader, err := factor3.Bind(&conf, viperInstance, flagset)
+	require.NoError(t, err, "factor3.Bind()")
+	require.NoError(t, flagset.Parse(nil))
+	require.NoError(t, loader.Load(), "factor3.Load()")
+	assert.Equal(t, map[string]string{"X-Request-ID": "a"}, conf.Headers)
+
+	changed := make(chan struct{}, 1)
+	viperInstance.OnConfigChange(func(fsnotify.Event) {
+		select {
+		case changed <- struct{}{}:
+		default:
+		}
+	})
+	require.NoError(t, os.WriteFile(cfgFile, []byte("headers:\n  X-Request-ID: a\n  X-Trace: b\n"), 0o644))
+	select {
+	case <-changed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the config file change wasn't noticed")
+	}
+	require.NoError(t, loader.Load(), "factor3.Load()")
+	assert.Equal(t, map[string]string{"X-Request-ID": "a", "X-Trace": "b"}, conf.Headers)
+}
+
+type testStorage interface {
+	Kind() string
+}
+
+type testS3Storage struct {
+	Bucket string `flag:"bucket" json:"bucket" required:"true"`
+	Region string `flag:"region" json:"region" default:"us-east-1"`
+}
+
+func (testS3Storage) Kind() string { return "s3" }
+
+type testFSStorage struct {
+	Path   string `flag:"path" json:"path"`
+	Region string `flag:"region" json:"region"`
+}
+
+func (*testFSStorage) Kind() string { return "fs" }
+
+type testQueue interface {
+	Brokers() string
+}
+
+type testKafkaQueue struct {
+	Port int `flag:"port" json:"port" default:"9092"`
+}
+
+func (testKafkaQueue) Brokers() string { return "kafka" }
+
+type testAMQPQueue struct {
+	Port int `flag:"port" json:"port" default:"5672"`
+}
+
+func (testAMQPQueue) Brokers() string { return "amqp" }
+
+type testNATSQueue struct {
+	Port string `flag:"port" json:"port"`
+}
+
+func (testNATSQueue) Brokers() string { return "nats" }
+
+type testSink interface {
+	Brokers() string
+}
+
+func init() {
+	factor3.RegisterVariant[testStorage]("s3", testS3Storage{})
+	factor3.RegisterVariant[testStorage]("fs", &testFSStorage{})
+	factor3.RegisterVariant[testQueue]("kafka", testKafkaQueue{})
+	factor3.RegisterVariant[testQueue]("amqp", testAMQPQueue{})
+	factor3.RegisterVariant[testSink]("kafka", testKafkaQueue{})
+	factor3.RegisterVariant[testSink]("nats", testNATSQueue{})
+}
+
+func TestVariants(t *testing.T) {
+	assert.Panics(t, func() { factor3.RegisterVariant[testS3Storage]("s3", testS3Storage{}) })
+	assert.Panics(t, func() { factor3.RegisterVariant[testStorage]("s3", &testFSStorage{}) })
+
+	type Config struct {
+		Storage testStorage `flag:"storage" json:"storage"`
+		Backup  testStorage `json:"backup" discriminator:"kind"`
+	}
+
+	var conf Config
+	loader, _, flagset, err := bindTest(t, &conf, `
+storage:
+  type: s3
+  bucket: my-bucket
+`)
+	require.NoError(t, err, "factor3.Bind()")
+	assert.Equal(t, "Type of storage, one of fs, s3 (env TEST_STORAGE_TYPE, config key storage.type)", flagset.Lookup("storage-type").Usage)
+	assert.NotNil(t, flagset.Lookup("storage-bucket"))
+	assert.NotNil(t, flagset.Lookup("storage-path"))
+	assert.NotNil(t, flagset.Lookup("storage-region"))
+
+	require.NoError(t, flagset.Parse(nil))
+	require.NoError(t, loader.Load(), "factor3.Load()")
+	assert.Equal(t, testS3Storage{Bucket: "my-bucket", Region: "us-east-1"}, conf.Storage)
+	assert.Nil(t, conf.Backup)
+
+	t.Setenv("TEST_BACKUP_KIND", "fs")
+	t.Setenv("TEST_BACKUP_PATH", "/backup")
+	require.NoError(t, flagset.Parse([]string{"--storage-type", "fs", "--storage-path", "/data"}))
+	require.NoError(t, loader.Load(), "factor3.Load()")
+	assert.Equal(t, &testFSStorage{Path: "/data"}, conf.Storage)
+	assert.Equal(t, &testFSStorage{Path: "/backup"}, conf.Backup)
+
+	require.NoError(t, flagset.Parse([]string{"--storage-type", "gcs"}))
+	var lerr factor3.LoadError
+	require.ErrorAs(t, loader.Load(), &lerr)
+	assert.ErrorContains(t, lerr, `unknown type "gcs", must be one of fs, s3`)
+
+	var conf2 Config
+	loader, _, flagset, err = bindTest(t, &conf2, "storage:\n  type: s3\n")
+	require.NoError(t, err, "factor3.Bind()")
+	require.NoError(t, flagset.Parse(nil))
+	require.ErrorAs(t, loader.Load(), &lerr)
+	var merr factor3.MissingValueError
+	require.ErrorAs(t, lerr, &merr)
+	assert.Equal(t, "storage.bucket", merr.Path)
+}
+
+func TestVariantsEnvPrefix(t *testing.T) {
+	type Config struct {
+		Archive testStorage `json:"archive" envPrefix:"ARCHIVE_"`
+	}
+
+	var conf Config
+	loader, _, flagset, err := bindTest(t, &conf, "")
+	require.NoError(t, err, "factor3.Bind()")
+	require.NoError(t, flagset.Parse(nil))
+	t.Setenv("ARCHIVE_TYPE", "fs")
+	t.Setenv("ARCHIVE_PATH", "/archive")
+	require.NoError(t, loader.Load(), "factor3.Load()")
+	assert.Equal(t, &testFSStorage{Path: "/archive"}, conf.Archive)
+}
+
+func TestVariantsSharedFlags(t *testing.T) {
+	type Config struct {
+		Queue testQueue `flag:"queue" json:"queue"`
+	}
+
+	var conf Config
+	loader, _, flagset, err := bindTest(t, &conf, "queue:\n  type: kafka\n")
+	require.NoError(t, err, "factor3.Bind()")
+	assert.Equal(t, "0", flagset.Lookup("queue-port").DefValue, "the variants disagree on the default")
+	require.NoError(t, flagset.Parse(nil))
+	require.NoError(t, loader.Load(), "factor3.Load()")
+	assert.Equal(t, testKafkaQueue{Port: 9092}, conf.Queue)
+
+	require.NoError(t, flagset.Parse([]string{"--queue-type", "amqp", "--queue-port", "1"}))
+	require.NoError(t, loader.Load(), "factor3.Load()")
+	assert.Equal(t, testAMQPQueue{Port: 1}, conf.Queue)
+
+	type SinkConfig struct {
+		Sink testSink `flag:"sink" json:"sink"`
+	}
+	var sinkConf SinkConfig
+	_, _, _, err = bindTest(t, &sinkConf, "")
+	assert.ErrorContains(t, err, "flag --sink-port is int in another variant, not string")
+}
@@ -0,0 +1,113 @@
+package factor3
+
+import (
+	"fmt"
+	"reflect"
+	"slices"
+	"strings"
+)
+
+// Validator can be implemented by any struct in the config, at any nesting level.
+// Load() calls Validate() after all values were loaded, and fails if it returns an error.
+type Validator interface {
+	Validate() error
+}
+
+// AfterLoader can be implemented by any struct in the config, at any nesting level.
+// Load() calls AfterLoad() after all values were loaded and before validation,
+// which makes it the place to compute derived fields.
+type AfterLoader interface {
+	AfterLoad() error
+}
+
+// Defaulter can be implemented by any struct in the config, at any nesting level.
+// Bind() calls SetDefaults() before registering flags, so the defaults show up in the flags usage,
+// and are loaded beneath InitArgs.Defaults. Use it for defaults computed at runtime (e.g number of CPUs),
+// and the `default:"..."` tag, which only applies to fields that are still zero, for static ones.
+// Nested structs are called first, so a struct can override the defaults of the structs it contains.
+type Defaulter interface {
+	SetDefaults()
+}
+
+func applyDefaulters(root reflect.Value) {
+	walkStructs(root, nil, nil, "SetDefaults", func(v reflect.Value, _ []string) {
+		if d, ok := v.Addr().Interface().(Defaulter); ok {
+			d.SetDefaults()
+		}
+	})
+}
+
+// callHooks calls `call` on every struct in `root` (including itself) that implements the interface T.
+// Nested structs are called before the structs that contain them.
+func callHooks[T any](root reflect.Value, naming NamingStrategy, hook string, call func(T) error) []error {
+	var errs []error
+	walkStructs(root, naming, nil, hook, func(v reflect.Value, path []string) {
+		impl, ok := v.Addr().Interface().(T)
+		if !ok {
+			return
+		}
+		if err := call(impl); err != nil {
+			errs = append(errs, HookError{Path: strings.Join(path, "."), Hook: hook, Err: err})
+		}
+	})
+	return errs
+}
+
+// walkStructs calls `fn` on every struct in `v`, depth first, including the values of maps.
+// An embedded struct is skipped when the struct embedding it has `method`, either its own or promoted,
+// and so are unexported embedded structs, whose methods can't be called.
+func walkStructs(v reflect.Value, naming NamingStrategy, path []string, method string, fn func(v reflect.Value, path []string)) {
+	switch v.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		if !v.IsNil() {
+			walkStructs(v.Elem(), naming, path, method, fn)
+		}
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			elemPath := slices.Clone(path)
+			if len(elemPath) > 0 {
+				elemPath[len(elemPath)-1] += fmt.Sprintf("[%d]", i)
+			}
+			walkStructs(v.Index(i), naming, elemPath, method, fn)
+		}
+	case reflect.Map:
+		if canParseString(v.Type().Elem()) {
+			return
+		}
+		iter := v.MapRange()
+		for iter.Next() {
+			// map values aren't addressable, so they're walked in a copy
+			e := deepCopy(iter.Value())
+			walkStructs(e, naming, append(slices.Clone(path), fmt.Sprint(iter.Key().Interface())), method, fn)
+			v.SetMapIndex(iter.Key(), e)
+		}
+	case reflect.Struct:
+		walkFields(v, naming, path, method, fn)
+		if v.CanAddr() && v.CanInterface() {
+			fn(v, path)
+		}
+	}
+}
+
+func walkFields(v reflect.Value, naming NamingStrategy, path []string, method string, fn func(v reflect.Value, path []string)) {
+	_, hasMethod := reflect.PointerTo(v.Type()).MethodByName(method)
+	for i := 0; i < v.NumField(); i++ {
+		f := v.Type().Field(i)
+		if skipField(f) {
+			continue
+		}
+		fieldPath := path
+		if !isSquashed(f) {
+			fieldPath = append(slices.Clone(path), toJSONName(f, naming))
+		}
+		fv := reflect.Indirect(v.Field(i))
+		if !f.Anonymous || fv.Kind() != reflect.Struct {
+			walkStructs(v.Field(i), naming, fieldPath, method, fn)
+			continue
+		}
+		walkFields(fv, naming, fieldPath, method, fn)
+		if !hasMethod && fv.CanAddr() && fv.CanInterface() {
+			fn(fv, fieldPath)
+		}
+	}
+}
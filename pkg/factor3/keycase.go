@@ -0,0 +1,149 @@
+package factor3
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"strings"
+
+	"github.com/pelletier/go-toml/v2"
+	"gopkg.in/yaml.v3"
+)
+
+// viper lowercases every key it reads, so factor3 parses the config file and the embedded defaults
+// once more, and restores the keys of maps loaded from them (e.g http headers) to their case.
+
+// hasStringMap reports whether values of `t` contain maps with string keys
+func hasStringMap(t reflect.Type, seen map[reflect.Type]bool) bool {
+	if seen[t] || hasStringForm(t) {
+		return false
+	}
+	seen[t] = true
+	switch t.Kind() {
+	case reflect.Map:
+		return t.Key().Kind() == reflect.String || hasStringMap(t.Elem(), seen)
+	case reflect.Pointer, reflect.Slice, reflect.Array:
+		return hasStringMap(t.Elem(), seen)
+	case reflect.Struct:
+		for i := 0; i < t.NumField(); i++ {
+			if f := t.Field(i); !skipField(f) && hasStringMap(f.Type, seen) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// parseRawConfig parses a config file without changing the case of its keys
+func parseRawConfig(name string, b []byte) (map[string]any, error) {
+	var raw map[string]any
+	var err error
+	switch strings.ToLower(strings.TrimPrefix(filepath.Ext(name), ".")) {
+	case "yaml", "yml":
+		err = yaml.Unmarshal(b, &raw)
+	case "json":
+		err = json.Unmarshal(b, &raw)
+	case "toml":
+		err = toml.Unmarshal(b, &raw)
+	default:
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parsing %q: %w", name, err)
+	}
+	return raw, nil
+}
+
+// rawConfigs are the config file and the embedded defaults, in this order
+func (st *viperState) rawConfigs() []map[string]any {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	var raws []map[string]any
+	for _, raw := range []map[string]any{st.rawConfig, st.rawDefaults} {
+		if raw != nil {
+			raws = append(raws, raw)
+		}
+	}
+	return raws
+}
+
+// rawValueAt finds the value at `viperPath` in `raw`, matching keys case insensitively like viper
+func rawValueAt(raw map[string]any, viperPath string) (any, bool) {
+	var v any = raw
+	for _, key := range strings.Split(viperPath, ".") {
+		m, ok := v.(map[string]any)
+		if !ok {
+			return nil, false
+		}
+		found := false
+		for k, mv := range m {
+			if strings.EqualFold(k, key) {
+				v, found = mv, true
+				break
+			}
+		}
+		if !found {
+			return nil, false
+		}
+	}
+	return v, true
+}
+
+// restoreKeyCase renames the lower case keys of maps in `v` to their case in `raw`.
+// Keys that are not lower case already came with their case (e.g from env vars), and are left alone.
+func restoreKeyCase(v reflect.Value, raw any, naming NamingStrategy) {
+	if hasStringForm(v.Type()) {
+		return
+	}
+	switch v.Kind() {
+	case reflect.Pointer:
+		if !v.IsNil() {
+			restoreKeyCase(v.Elem(), raw, naming)
+		}
+	case reflect.Slice, reflect.Array:
+		rs, _ := raw.([]any)
+		for i := 0; i < v.Len() && i < len(rs); i++ {
+			restoreKeyCase(v.Index(i), rs[i], naming)
+		}
+	case reflect.Struct:
+		rm, ok := raw.(map[string]any)
+		if !ok {
+			return
+		}
+		for i := 0; i < v.NumField(); i++ {
+			f := v.Type().Field(i)
+			if skipField(f) {
+				continue
+			}
+			if isSquashed(f) {
+				restoreKeyCase(v.Field(i), rm, naming)
+				continue
+			}
+			if fraw, ok := rawValueAt(rm, toJSONName(f, naming)); ok {
+				restoreKeyCase(v.Field(i), fraw, naming)
+			}
+		}
+	case reflect.Map:
+		rm, ok := raw.(map[string]any)
+		if !ok || v.IsNil() || v.Type().Key().Kind() != reflect.String {
+			return
+		}
+		for rk, rv := range rm {
+			key := reflect.ValueOf(rk).Convert(v.Type().Key())
+			lower := reflect.ValueOf(strings.ToLower(rk)).Convert(v.Type().Key())
+			if lower.String() != rk && v.MapIndex(lower).IsValid() && !v.MapIndex(key).IsValid() {
+				v.SetMapIndex(key, v.MapIndex(lower))
+				v.SetMapIndex(lower, reflect.Value{})
+			}
+			e := v.MapIndex(key)
+			if !e.IsValid() {
+				continue
+			}
+			// map values aren't addressable, so they're restored in a copy
+			c := deepCopy(e)
+			restoreKeyCase(c, rv, naming)
+			v.SetMapIndex(key, c)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package factor3
+
+import (
+	"reflect"
+	"strings"
+	"unicode"
+)
+
+// NamingStrategy converts the name of a struct field to its config key,
+// for fields that don't have a `json:"..."` tag.
+type NamingStrategy func(fieldName string) string
+
+// Option configures a Loader created by Bind()
+type Option func(l *Loader)
+
+// WithNaming sets the naming strategy of config keys (and so of env vars) for fields without a `json:"..."` tag.
+// By default, the field name is used as is, e.g `LongerString` (which viper matches case insensitively).
+// It also names the flags of fields without a `flag:"..."` tag, see WithAutoFlags().
+func WithNaming(naming NamingStrategy) Option {
+	return func(l *Loader) {
+		l.naming = naming
+	}
+}
+
+// WithAutoFlags registers a flag for every leaf field, not only the ones with a `flag:"..."` tag.
+// Fields without a `flag:"..."` tag are named by the naming strategy, or in kebab case without one,
+// e.g `--log-longer-string`.
+func WithAutoFlags() Option {
+	return func(l *Loader) {
+		l.autoFlags = true
+	}
+}
+
+// WithFlagSeparator sets the separator of nested fields in flag names. Defaults to "-",
+// e.g WithFlagSeparator(".") names the flag of `log.level` --log.level
+func WithFlagSeparator(sep string) Option {
+	return func(l *Loader) {
+		l.flagSeparator = sep
+	}
+}
+
+// SnakeCase converts `LongerString` to `longer_string`
+func SnakeCase(fieldName string) string {
+	return strings.Join(lowerWords(fieldName), "_")
+}
+
+// KebabCase converts `LongerString` to `longer-string`
+func KebabCase(fieldName string) string {
+	return strings.Join(lowerWords(fieldName), "-")
+}
+
+// CamelCase converts `LongerString` to `longerString`
+func CamelCase(fieldName string) string {
+	words := lowerWords(fieldName)
+	for i := 1; i < len(words); i++ {
+		words[i] = strings.ToUpper(words[i][:1]) + words[i][1:]
+	}
+	return strings.Join(words, "")
+}
+
+// lowerWords splits a Go identifier into lower case words, keeping acronyms together,
+// e.g `HTTPServerID` is split to `http`, `server` and `id`.
+func lowerWords(name string) []string {
+	var words []string
+	runes := []rune(name)
+	start := 0
+	for i := 0; i <= len(runes); i++ {
+		boundary := i == len(runes) || runes[i] == '_' || runes[i] == '-'
+		if !boundary && i > start {
+			prev, cur := runes[i-1], runes[i]
+			next := rune(0)
+			if i+1 < len(runes) {
+				next = runes[i+1]
+			}
+			boundary = unicode.IsUpper(cur) && (!unicode.IsUpper(prev) || unicode.IsLower(next))
+		}
+		if !boundary {
+			continue
+		}
+		if i > start {
+			words = append(words, strings.ToLower(string(runes[start:i])))
+		}
+		start = i
+		if i < len(runes) && (runes[i] == '_' || runes[i] == '-') {
+			start = i + 1
+		}
+	}
+	return words
+}
+
+// keyName is the config key of `f`, which is the first part of its json tag,
+// or its name according to the naming strategy.
+func (l *Loader) keyName(f reflect.StructField) string {
+	return toJSONName(f, l.naming)
+}
+
+// flagName is the part of `f` in the flag name of the fields below it
+func (l *Loader) flagName(f reflect.StructField) string {
+	if name, ok := f.Tag.Lookup("flag"); ok || !l.autoFlags {
+		return name
+	}
+	if l.naming != nil {
+		return l.naming(f.Name)
+	}
+	return KebabCase(f.Name)
+}
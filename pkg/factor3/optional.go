@@ -0,0 +1,91 @@
+package factor3
+
+import (
+	"os"
+	"reflect"
+	"slices"
+)
+
+// optionalField is a pointer field, which Load() leaves nil unless a config file, an env var or a flag
+// sets one of the keys under it. Defaults alone don't allocate it, but they fill it once it is.
+type optionalField struct {
+	index []int
+	// viperPath is the key of the field, or empty for embedded structs, whose keys are promoted
+	viperPath string
+	// leaves are the keys of the values loaded under the field
+	leaves []string
+	// always is set for pointers that were already allocated when Bind() was called
+	always bool
+}
+
+// visitOptional visits the value `v` points to, or a zero value if it's nil, since
+// the pointer itself is only allocated by Load()
+func (l *Loader) visitOptional(v reflect.Value, viperPath string, visitElem func(elem reflect.Value) error) error {
+	opt := &optionalField{
+		index:     slices.Clone(l.index),
+		viperPath: viperPath,
+		always:    !v.IsNil(),
+	}
+	l.optionals = append(l.optionals, opt)
+
+	elem := v
+	if v.IsNil() {
+		elem = reflect.New(v.Type().Elem())
+		applyDefaulters(elem.Elem())
+	}
+	l.openOptionals = append(l.openOptionals, opt)
+	defer func() { l.openOptionals = l.openOptionals[:len(l.openOptionals)-1] }()
+	return visitElem(elem.Elem())
+}
+
+// addOptionalLeaf adds the current field to the optional fields it's under
+func (l *Loader) addOptionalLeaf() {
+	for _, opt := range l.openOptionals {
+		opt.leaves = append(opt.leaves, l.jpathString())
+	}
+}
+
+// resolveOptionals allocates the optional fields in `root` that are set, and sets the rest to nil
+func (l *Loader) resolveOptionals(root reflect.Value) {
+	// optional fields are registered before the optional fields under them
+	for _, opt := range l.optionals {
+		parent := fieldByIndex(root, opt.index[:len(opt.index)-1])
+		if !parent.IsValid() {
+			continue // under an optional field that is nil
+		}
+		p := parent.Field(opt.index[len(opt.index)-1])
+		if !opt.always && !l.isSet(opt) {
+			p.Set(reflect.Zero(p.Type()))
+		} else if p.IsNil() {
+			p.Set(reflect.New(p.Type().Elem()))
+		}
+	}
+}
+
+func (l *Loader) isSet(opt *optionalField) bool {
+	if opt.viperPath != "" && l.viper.InConfig(opt.viperPath) {
+		return true
+	}
+	return slices.ContainsFunc(opt.leaves, l.isSetBySource)
+}
+
+// isSetBySource reports whether a config file, an env var or a flag sets `viperPath`,
+// unlike viper.IsSet(), which is also true for defaults
+func (l *Loader) isSetBySource(viperPath string) bool {
+	if l.viper.InConfig(viperPath) {
+		return true
+	}
+	for _, name := range l.viper.state.envNames(viperPath) {
+		if _, ok := os.LookupEnv(name); ok {
+			return true
+		}
+	}
+	if l.pflagset != nil {
+		for flagName, path := range l.viperPathByPFlagName {
+			if f := l.pflagset.Lookup(flagName); path == viperPath && f != nil && f.Changed {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -2,29 +2,50 @@ package factor3
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 	"reflect"
 	"slices"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/spf13/pflag"
-	"github.com/spf13/viper"
 
 	"github.com/drornir/factor3/pkg/log"
 )
 
 type Loader struct {
-	viper    *viper.Viper
+	viper    *Viper
 	pflagset *pflag.FlagSet
 
 	jpath                []string
 	fpath                []string
+	fields               []visitedField
+	index                []int
+	envScopes            []envScope
+	optionals            []*optionalField
+	openOptionals        []*optionalField
 	viperPathByPFlagName map[string]string
-
-	loaders []func() error
-	boundTo *any
+	elementFlagNames     map[string]bool
+	elementChecks        []elementCheck
+	elementRules         []elementRule
+	// sharedFlags are flags of variants of an interface field, which are shared between the variants
+	sharedFlags map[string]*sharedFlag
+	// variantDefaults is set in Loaders of variants of interface fields, see loadVariant()
+	variantDefaults reflect.Value
+	viperPaths      []string
+
+	loaders     []func(root reflect.Value) error
+	required    []requiredField
+	validations []fieldValidation
+	rules       []structRule
+	boundTo     *any
+	root        reflect.Value
+
+	naming        NamingStrategy
+	autoFlags     bool
+	flagSeparator string
 
 	lock *sync.RWMutex
 }
@@ -32,7 +53,7 @@ type Loader struct {
 // Bind creates a loader from `into`, which should be a pointer to a struct.
 //
 // `viper` must be non-nil, because you should configure your viper instance
-// to.
+// to. Pass the same instance from NewViper() to InitializeViper().
 //
 // `pflagset` can be nil, but that turns off flags support.
 // To enable it, you need to pass an initialized `*pflag.FlagSet`.
@@ -45,15 +66,31 @@ type Loader struct {
 //  2. Create a new flagset, but don't bind it directly. Annotated toy struct fields with
 //     `flag:"flag-name"` and Bind() will discover it and register it on you pflagset
 //
-// In both cases, viper.BindFlagValues() will be called on `pflagset` before returning from this function
-func Bind(into any, viper *viper.Viper, pflagset *pflag.FlagSet) (*Loader, error) {
+// In both cases, viper.BindFlagValues() will be called on `pflagset` before returning from this function.
+//
+// Options change how fields are named, see WithNaming(), WithAutoFlags() and WithFlagSeparator().
+//
+// If embedded defaults were registered with InitArgs.Defaults, Bind() returns a ParseError
+// when they contain keys that don't exist in `into`.
+func Bind(into any, viper *Viper, pflagset *pflag.FlagSet, opts ...Option) (*Loader, error) {
 	l := newLoader(viper, pflagset)
+	for _, opt := range opts {
+		opt(l)
+	}
 	if err := l.bind(into); err != nil {
 		return nil, err
 	}
 	return l, nil
 }
 
+// Load reads the values from all sources into the struct passed to Bind().
+//
+// Values are loaded into a copy of the struct first, and only if loading and validation
+// succeed the copy is assigned to the bound struct. On error, the bound struct is left untouched.
+//
+// After loading, AfterLoad() is called on every struct in the config that implements AfterLoader,
+// and then it's validated by the `required` and `validate` tags, by rules from RegisterRule(),
+// and by calling Validate() on every struct that implements Validator.
 func (l *Loader) Load() error {
 	l.lock.RLock()
 	defer l.lock.RUnlock()
@@ -62,25 +99,67 @@ func (l *Loader) Load() error {
 		return fmt.Errorf("Bind() needs to be called before calling Load() for the first time")
 	}
 
+	if l.viper != nil {
+		if err := l.viper.state.bindEnvs(l.viper.Viper); err != nil {
+			return err
+		}
+	}
+
+	staged := deepCopy(l.root.Elem())
+	l.resolveOptionals(staged)
 	var errs []error
 	for _, loader := range l.loaders {
-		err := loader()
+		err := loader(staged)
 		if err != nil {
 			errs = append(errs, err)
 		}
 	}
+	errs = append(errs, callHooks(staged, l.naming, "AfterLoad", AfterLoader.AfterLoad)...)
+	errs = append(errs, l.checkRequired(staged)...)
+	errs = append(errs, l.validate(staged)...)
+	errs = append(errs, l.checkElements(staged)...)
+	errs = append(errs, l.evalRules(staged)...)
+	errs = append(errs, callHooks(staged, l.naming, "Validate", Validator.Validate)...)
 	if len(errs) > 0 {
 		return LoadError{Errs: errs}
 	}
+	l.root.Elem().Set(staged)
 	return nil
 }
 
-func newLoader(viper *viper.Viper, pflagset *pflag.FlagSet) *Loader {
+type requiredField struct {
+	viperPath  string
+	flagName   string
+	index      []int
+	hasDefault bool
+}
+
+// checkRequired returns a MissingValueError for every required field that no source has set.
+// Fields under optional fields that are not set are not required.
+func (l *Loader) checkRequired(root reflect.Value) []error {
+	var errs []error
+	for i := len(l.required) - 1; i >= 0; i-- {
+		rf := l.required[i]
+		if rf.hasDefault || l.viper.IsSet(rf.viperPath) || !fieldByIndex(root, rf.index).IsValid() {
+			continue
+		}
+		errs = append(errs, MissingValueError{
+			Path: rf.viperPath,
+			Env:  l.viper.state.envName(rf.viperPath),
+			Flag: rf.flagName,
+		})
+	}
+	return errs
+}
+
+func newLoader(viper *Viper, pflagset *pflag.FlagSet) *Loader {
 	return &Loader{
 		viper:                viper,
 		pflagset:             pflagset,
 		lock:                 &sync.RWMutex{},
 		viperPathByPFlagName: map[string]string{},
+		elementFlagNames:     map[string]bool{},
+		flagSeparator:        "-",
 	}
 }
 
@@ -94,15 +173,23 @@ func (l *Loader) bind(into any) error {
 	}
 
 	l.boundTo = &into
+	l.root = reflected
+	applyDefaulters(reflected.Elem())
 	if err := l.visit(reflected.Elem()); err != nil {
 		return ParseError{Err: err, Value: into}
 	}
+	if l.viper != nil {
+		if err := l.viper.state.bind(l.viperPaths); err != nil {
+			return ParseError{Err: err, Value: into}
+		}
+	}
 	if l.pflagset != nil && l.viper != nil {
 		log.GG().D(context.TODO(), "binding pflags to viper")
 
 		l.viper.BindFlagValues(viperFlagsAdapter{
 			pfs:            l.pflagset,
 			vipathByPFName: l.viperPathByPFlagName,
+			skip:           l.elementFlagNames,
 		})
 	}
 
@@ -110,6 +197,10 @@ func (l *Loader) bind(into any) error {
 }
 
 func (l *Loader) visit(v reflect.Value) error {
+	if hasStringForm(v.Type()) {
+		return l.visitLeaf(v)
+	}
+
 	switch v.Type().Kind() {
 	case reflect.Bool,
 		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Float32, reflect.Float64,
@@ -119,128 +210,447 @@ func (l *Loader) visit(v reflect.Value) error {
 		reflect.Map,
 		reflect.Slice, reflect.Array:
 
-		l.registerPflag(v)
-		l.registerViper(v.Addr())
-		l.addPflagNameToViperMapping()
+		return l.visitLeaf(v)
 
-		return nil
+	case reflect.Pointer:
+		return l.visitOptional(v, l.jpathString(), l.visit)
+	case reflect.Interface:
+		return l.visitVariants(v)
+	case reflect.Struct:
+		if err := l.registerRules(v); err != nil {
+			return err
+		}
+		return l.visitFields(v, nil)
+	default:
+		return l.errWithContext(fmt.Sprintf("unsupported type %s", v.Type()), v, strings.Join(l.jpath, "."))
+	}
+}
 
-	case reflect.Pointer: // should i have pointers?
-		if v.IsNil() {
-			// fmt.Fprintln(os.Stderr, "v is nil", v)
-			v.Set(reflect.New(v.Type().Elem()))
+// visitFields visits the fields of the struct `v`. The fields of embedded structs are promoted to `v`,
+// unless a field of `v` (or of the struct `v` is promoted to) has the same key, which is in `shadowed`.
+func (l *Loader) visitFields(v reflect.Value, shadowed map[string]bool) error {
+	own := map[string]bool{}
+	for i := 0; i < v.NumField(); i++ {
+		if f := v.Type().Field(i); !skipField(f) && !isSquashed(f) {
+			own[strings.ToLower(l.keyName(f))] = true
 		}
-		if err := l.visit(v.Elem()); err != nil {
-			return err
+	}
+	for k := range shadowed {
+		own[k] = true
+	}
+
+	for i := v.NumField() - 1; i >= 0; i-- {
+		f := v.Type().Field(i)
+		if skipField(f) {
+			continue
 		}
-		return nil
-	case reflect.Struct:
-		for i := v.NumField() - 1; i >= 0; i-- {
-			f := v.Type().Field(i)
-			l.jpath = append(l.jpath, toJSONName(f))
-			l.fpath = append(l.fpath, f.Tag.Get("flag"))
-			vv := v.Field(i)
-			if err := l.visit(vv); err != nil {
-				return err
+		squashed := isSquashed(f)
+		if !squashed && shadowed[strings.ToLower(l.keyName(f))] {
+			continue
+		}
+		if !squashed {
+			l.jpath = append(l.jpath, l.keyName(f))
+			l.fpath = append(l.fpath, l.flagName(f))
+		} else if flag := f.Tag.Get("flag"); flag != "" {
+			l.fpath = append(l.fpath, flag)
+		}
+		l.fields = append(l.fields, visitedField{StructField: f, parent: v.Type()})
+		l.index = append(l.index, i)
+		prefix, scoped := f.Tag.Lookup("envPrefix")
+		if scoped {
+			l.envScopes = append(l.envScopes, envScope{prefix: prefix, depth: len(l.jpath)})
+		}
+		vv := v.Field(i)
+		var err error
+		if squashed {
+			visitEmbedded := func(elem reflect.Value) error {
+				if err := l.registerRules(elem); err != nil {
+					return err
+				}
+				return l.visitFields(elem, own)
+			}
+			if vv.Kind() == reflect.Pointer {
+				err = l.visitOptional(vv, "", visitEmbedded)
+			} else {
+				err = visitEmbedded(vv)
 			}
+		} else {
+			err = l.visit(vv)
+		}
+		if err != nil {
+			return err
+		}
+		if scoped {
+			l.envScopes = l.envScopes[:len(l.envScopes)-1]
+		}
+		if !squashed {
 			l.jpath = l.jpath[:len(l.jpath)-1]
 			l.fpath = l.fpath[:len(l.fpath)-1]
+		} else if f.Tag.Get("flag") != "" {
+			l.fpath = l.fpath[:len(l.fpath)-1]
 		}
-		return nil
-	default:
-		return l.errWithContext("value cannot be visited", v, strings.Join(l.jpath, "."))
+		l.fields = l.fields[:len(l.fields)-1]
+		l.index = l.index[:len(l.index)-1]
 	}
+	return nil
 }
 
-func (l *Loader) registerPflag(v reflect.Value) {
+// isSquashed reports whether `f` is an embedded struct whose fields are promoted to the struct
+// that embeds it, like in encoding/json. A name in the json tag, or `factor3:"nested"`, keeps it nested.
+func isSquashed(f reflect.StructField) bool {
+	if !f.Anonymous || hasOption(f, "nested") {
+		return false
+	}
+	if name, _, _ := strings.Cut(f.Tag.Get("json"), ","); name != "" {
+		return false
+	}
+	t := f.Type
+	if t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	return t.Kind() == reflect.Struct && !hasStringForm(t)
+}
+
+// skipField reports whether `f` is not part of the config: unexported fields (except embedded structs),
+// and fields tagged with `factor3:"-"` or `json:"-"`
+func skipField(f reflect.StructField) bool {
+	if hasOption(f, "-") || f.Tag.Get("json") == "-" {
+		return true
+	}
+	// the exported fields of unexported embedded structs are promoted
+	return !f.IsExported() && !(isSquashed(f) && f.Type.Kind() == reflect.Struct)
+}
+
+// isLoadable reports whether values of type `t` can be decoded from config sources,
+// which rules out channels, functions and complex numbers anywhere inside it
+func isLoadable(t reflect.Type, seen map[reflect.Type]bool) bool {
+	if seen[t] || hasStringForm(t) {
+		return true
+	}
+	seen[t] = true
+	switch t.Kind() {
+	case reflect.Chan, reflect.Func, reflect.UnsafePointer, reflect.Complex64, reflect.Complex128:
+		return false
+	case reflect.Pointer, reflect.Slice, reflect.Array:
+		return isLoadable(t.Elem(), seen)
+	case reflect.Map:
+		return isLoadable(t.Key(), seen) && isLoadable(t.Elem(), seen)
+	case reflect.Struct:
+		for i := 0; i < t.NumField(); i++ {
+			if f := t.Field(i); !skipField(f) && !isLoadable(f.Type, seen) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// visitLeaf registers a value that is loaded as a whole from a single viper key
+func (l *Loader) visitLeaf(v reflect.Value) error {
+	if !isLoadable(v.Type(), map[reflect.Type]bool{}) {
+		return l.errWithContext(fmt.Sprintf("unsupported type %s", v.Type()), v, l.jpathString())
+	}
+	if err := l.applyDefaults(v); err != nil {
+		return err
+	}
+	if err := l.registerEnv(v); err != nil {
+		return err
+	}
+	if err := l.registerPflag(v); err != nil {
+		return err
+	}
+	l.registerViper(v)
+	if err := l.registerElements(v); err != nil {
+		return err
+	}
+	l.addOptionalLeaf()
+	l.addPflagNameToViperMapping()
+	l.registerRequired(v)
+	if err := l.registerValidation(v); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (l *Loader) registerPflag(v reflect.Value) error {
 	if l.pflagset == nil {
-		return // TODO log WARN
+		return nil // TODO log WARN
 	}
 
 	flagsPath := l.fpathString()
-	if flagsPath == "" {
-		return // TODO log DEBUG
+	if !l.hasFlag() {
+		return nil // TODO log DEBUG
+	}
+
+	// pflag panics on redefined flags, so we check before registering
+	if sf, ok := l.sharedFlags[flagsPath]; ok {
+		return l.shareFlag(sf, v) // registered by another variant
+	}
+	if l.pflagset.Lookup(flagsPath) != nil {
+		return l.errWithContext(fmt.Sprintf("flag --%s is already defined", flagsPath), v, l.jpathString())
+	}
+	short := l.currentField().Tag.Get("short")
+	if short != "" {
+		if len(short) != 1 {
+			return l.errWithContext(fmt.Sprintf("flag shorthand %q must be a single character", short), v, l.jpathString())
+		}
+		if other := l.pflagset.ShorthandLookup(short); other != nil {
+			return l.errWithContext(fmt.Sprintf("flag shorthand -%s of --%s is already used by --%s", short, flagsPath, other.Name), v, l.jpathString())
+		}
 	}
 
+	description := l.currentField().description()
+	if !addPflag(l.pflagset, v, flagsPath, short, description) {
+		// don't register anything if it's not a supported type
+		return nil
+	}
+	if l.sharedFlags != nil {
+		l.sharedFlags[flagsPath] = &sharedFlag{def: deepCopy(v)}
+	}
+	l.setFlagUsage(flagsPath, description)
+	return nil
+}
+
+// addPflag adds a flag with the default `v` to `fs`, and reports whether the type of `v` is supported
+func addPflag(fs *pflag.FlagSet, v reflect.Value, flagsPath, short, description string) bool {
+	if hasStringForm(v.Type()) {
+		fs.VarP(newFlagValue(v), flagsPath, short, description)
+		return true
+	}
 	switch v.Type().Kind() {
 	case reflect.Bool:
 		c := v.Convert(reflect.TypeOf(bool(false))).Interface().(bool)
-		l.pflagset.Bool(flagsPath, c, "")
+		fs.BoolP(flagsPath, short, c, description)
 	case reflect.Int:
 		i := v.Convert(reflect.TypeOf(int(0))).Interface().(int)
-		l.pflagset.Int(flagsPath, i, "")
+		fs.IntP(flagsPath, short, i, description)
 	case reflect.Int8:
 		i := v.Convert(reflect.TypeOf(int8(0))).Interface().(int8)
-		l.pflagset.Int8(flagsPath, i, "")
+		fs.Int8P(flagsPath, short, i, description)
 	case reflect.Int16:
 		i := v.Convert(reflect.TypeOf(int16(0))).Interface().(int16)
-		l.pflagset.Int16(flagsPath, i, "")
+		fs.Int16P(flagsPath, short, i, description)
 	case reflect.Int32:
 		i := v.Convert(reflect.TypeOf(int32(0))).Interface().(int32)
-		l.pflagset.Int32(flagsPath, i, "")
+		fs.Int32P(flagsPath, short, i, description)
 	case reflect.Int64:
 		i := v.Convert(reflect.TypeOf(int64(0))).Interface().(int64)
-		l.pflagset.Int64(flagsPath, i, "")
+		fs.Int64P(flagsPath, short, i, description)
 	case reflect.Uint:
 		i := v.Convert(reflect.TypeOf(uint(0))).Interface().(uint)
-		l.pflagset.Uint(flagsPath, i, "")
+		fs.UintP(flagsPath, short, i, description)
 	case reflect.Uint8:
 		i := v.Convert(reflect.TypeOf(uint8(0))).Interface().(uint8)
-		l.pflagset.Uint8(flagsPath, i, "")
+		fs.Uint8P(flagsPath, short, i, description)
 	case reflect.Uint16:
 		i := v.Convert(reflect.TypeOf(uint16(0))).Interface().(uint16)
-		l.pflagset.Uint16(flagsPath, i, "")
+		fs.Uint16P(flagsPath, short, i, description)
 	case reflect.Uint32:
 		i := v.Convert(reflect.TypeOf(uint32(0))).Interface().(uint32)
-		l.pflagset.Uint32(flagsPath, i, "")
+		fs.Uint32P(flagsPath, short, i, description)
 	case reflect.Uint64:
 		i := v.Convert(reflect.TypeOf(uint64(0))).Interface().(uint64)
-		l.pflagset.Uint64(flagsPath, i, "")
+		fs.Uint64P(flagsPath, short, i, description)
 	case reflect.Float32:
-		f := v.Convert(reflect.TypeOf(float64(0))).Interface().(float32)
-		l.pflagset.Float32(flagsPath, f, "")
+		f := v.Convert(reflect.TypeOf(float32(0))).Interface().(float32)
+		fs.Float32P(flagsPath, short, f, description)
 	case reflect.Float64:
 		f := v.Convert(reflect.TypeOf(float64(0))).Interface().(float64)
-		l.pflagset.Float64(flagsPath, f, "")
+		fs.Float64P(flagsPath, short, f, description)
 	case reflect.String:
 		s := v.Convert(reflect.TypeOf("")).Interface().(string)
-		l.pflagset.String(flagsPath, s, "")
+		fs.StringP(flagsPath, short, s, description)
+	case reflect.Slice:
+		// only slices that viper knows how to read from pflag
+		switch t := v.Type(); {
+		case t.Elem() == durationType:
+			d := v.Convert(reflect.TypeOf([]time.Duration(nil))).Interface().([]time.Duration)
+			fs.DurationSliceP(flagsPath, short, d, description)
+		case t.ConvertibleTo(reflect.TypeOf([]string(nil))):
+			s := v.Convert(reflect.TypeOf([]string(nil))).Interface().([]string)
+			fs.StringSliceP(flagsPath, short, s, description)
+		case t.ConvertibleTo(reflect.TypeOf([]int(nil))):
+			i := v.Convert(reflect.TypeOf([]int(nil))).Interface().([]int)
+			fs.IntSliceP(flagsPath, short, i, description)
+		default:
+			return false
+		}
+	case reflect.Map:
+		switch t := v.Type(); {
+		case t.ConvertibleTo(reflect.TypeOf(map[string]string(nil))):
+			m := v.Convert(reflect.TypeOf(map[string]string(nil))).Interface().(map[string]string)
+			fs.StringToStringP(flagsPath, short, m, description)
+		case t.ConvertibleTo(reflect.TypeOf(map[string]int(nil))):
+			m := v.Convert(reflect.TypeOf(map[string]int(nil))).Interface().(map[string]int)
+			fs.StringToIntP(flagsPath, short, m, description)
+		default:
+			return false
+		}
 	default:
-		// don't register anything if it's not a supported type
+		return false
 	}
+	return true
+}
+
+// applyDefaults sets the zero value `v` from the `default:"..."` tag, so it shows up as the flag's default,
+// and sets the tag as the default in viper unless SetDefaults() or the struct set another value.
+// registerViper() loads `v`, wherever its value came from, when viper has no value for the field.
+func (l *Loader) applyDefaults(v reflect.Value) error {
+	s, ok := l.currentField().Tag.Lookup("default")
+	if !ok {
+		return nil
+	}
+	def, err := parseString(v.Type(), s)
+	if err != nil {
+		return l.errWithContext(fmt.Sprintf("invalid default tag %q: %s", s, err), v, l.jpathString())
+	}
+	if v.IsZero() {
+		v.Set(def)
+	}
+	// variants share keys, so their defaults are applied by loadVariant() instead
+	if l.viper != nil && !l.variantDefaults.IsValid() && reflect.DeepEqual(v.Interface(), def.Interface()) {
+		l.viper.state.setTagDefault(l.viper.Viper, l.jpathString(), s)
+	}
+	return nil
+}
+
+func (l *Loader) registerRequired(v reflect.Value) {
+	if !isRequired(l.currentField().StructField) {
+		return
+	}
+	var flagName string
+	if l.pflagset != nil && l.hasFlag() {
+		flagName = l.fpathString()
+	}
+	l.required = append(l.required, requiredField{
+		viperPath:  l.jpathString(),
+		flagName:   flagName,
+		index:      slices.Clone(l.index),
+		hasDefault: !v.IsZero(),
+	})
+}
+
+// isRequired reports whether `f` is tagged with `required:"true"` or `factor3:"required"`
+func isRequired(f reflect.StructField) bool {
+	if r, err := strconv.ParseBool(f.Tag.Get("required")); err == nil && r {
+		return true
+	}
+	return hasOption(f, "required")
+}
+
+// hasOption reports whether the comma separated `factor3:"..."` tag of `f` contains `opt`
+func hasOption(f reflect.StructField, opt string) bool {
+	return slices.Contains(strings.Split(f.Tag.Get("factor3"), ","), opt)
+}
+
+// visitedField is a struct field on the path from the bound struct to the value being visited
+type visitedField struct {
+	reflect.StructField
+	// parent is the type of the struct that has the field
+	parent reflect.Type
+}
+
+// currentField returns the field being visited, or the zero value when visiting the bound struct itself
+func (l *Loader) currentField() visitedField {
+	if len(l.fields) == 0 {
+		return visitedField{}
+	}
+	return l.fields[len(l.fields)-1]
 }
 
 func (l *Loader) jpathString() string {
 	return strings.Join(l.jpath, ".")
 }
 
-func (l *Loader) registerViper(vAddr reflect.Value) {
+func (l *Loader) registerViper(v reflect.Value) {
 	viperPath := l.jpathString()
-	loader := func() error {
+	index := slices.Clone(l.index)
+	l.viperPaths = append(l.viperPaths, viperPath)
+	hasMap := hasStringMap(v.Type(), map[reflect.Type]bool{})
+	def := deepCopy(v)
+	loader := func(root reflect.Value) error {
+		fv := fieldByIndex(root, index)
+		if !fv.IsValid() {
+			return nil // under an optional field that is not set
+		}
+		vAddr := fv.Addr()
 		// if !l.viper.IsSet(viperPath) {
 		// 	fmt.Fprintln(os.Stderr, "vAddr", vAddr, "T", vAddr.Type())
 		// 	vAddr.Set(reflect.Zero(vAddr.Type()))
 		// 	return nil
 		// }
 
+		if l.variantDefaults.IsValid() && !l.isSetBySource(viperPath) {
+			return nil
+		}
 		log.GG().D(context.Background(), "loading viper value", "path", viperPath)
 		untypedVal := l.viper.Get(viperPath)
 		if untypedVal == nil {
 			log.GG().D(context.TODO(), "value is nil", "path", viperPath)
-
+			fv.Set(deepCopy(def))
 			return nil
 		}
 		log.GG().D(context.Background(), "loaded viper value", "path", viperPath)
+		if s, ok := untypedVal.(string); ok && s == "" && !l.viper.IsSet(viperPath) {
+			// the default of a flag that wasn't set, which is empty for zero values
+			fv.Set(reflect.Zero(fv.Type()))
+			return nil
+		}
 		if err := unmarshalViper(vAddr, untypedVal); err != nil {
 			return l.errWithContext(err.Error(), vAddr.Elem(), viperPath)
 		}
+		if hasMap {
+			// the keys of maps are lowercased by viper
+			for _, raw := range l.viper.state.rawConfigs() {
+				if rv, ok := rawValueAt(raw, viperPath); ok {
+					restoreKeyCase(vAddr.Elem(), rv, l.naming)
+				}
+			}
+		}
 		return nil
 	}
 	l.loaders = append(l.loaders, loader)
 }
 
+// registerEnv binds the env vars in the `env:"NAME,ALIAS"` tag of the current field, used as written,
+// and the one from the closest `envPrefix:"..."` tag above it, after the env var derived from the config key.
+func (l *Loader) registerEnv(v reflect.Value) error {
+	if l.viper == nil {
+		return nil
+	}
+	var b envBinding
+	if len(l.envScopes) > 0 {
+		scope := l.envScopes[len(l.envScopes)-1]
+		b.scoped = true
+		b.scopePrefix = scope.prefix
+		b.scopePath = strings.Join(l.jpath[scope.depth:], ".")
+	}
+	if tag := l.currentField().Tag.Get("env"); tag != "" {
+		for _, name := range strings.Split(tag, ",") {
+			name = strings.TrimSpace(name)
+			if name == "" {
+				return l.errWithContext(fmt.Sprintf("invalid env tag %q", tag), v, l.jpathString())
+			}
+			b.aliases = append(b.aliases, name)
+		}
+	}
+	if !b.scoped && len(b.aliases) == 0 {
+		return nil
+	}
+	l.viper.state.addEnvBinding(l.jpathString(), b)
+	return nil
+}
+
+// envScope is an `envPrefix:"..."` tag on a field, whose value is the prefix of the env vars
+// of the fields under it, instead of the program's prefix and the path of the field
+type envScope struct {
+	prefix string
+	// depth is the length of jpath of the fields under the tagged field
+	depth int
+}
+
 func (l *Loader) addPflagNameToViperMapping() {
-	if l.fpathString() == "" {
+	if !l.hasFlag() {
 		return
 	}
 	l.viperPathByPFlagName[l.fpathString()] = l.jpathString()
@@ -251,31 +661,101 @@ func (l *Loader) errWithContext(msg string, v reflect.Value, jsonPath string) er
 	return fmt.Errorf("in json path %q and value %q : %s", jsonPath, v, msg)
 }
 
+// hasFlag is whether the current field has a flag, which requires a name of its own
+// and not only of the structs containing it
+func (l *Loader) hasFlag() bool {
+	return len(l.fpath) > 0 && l.fpath[len(l.fpath)-1] != ""
+}
+
 func (l *Loader) fpathString() string {
 	fp := append([]string(nil), l.fpath...)
 	fp = slices.DeleteFunc(fp, func(s string) bool { return s == "" })
-	return strings.Join(fp, "-")
+	return strings.Join(fp, l.flagSeparator)
 }
 
-func unmarshalViper(into reflect.Value, data any) error {
-	// TODO check if I can reuse something from viper
-	jsonBytes, err := json.Marshal(data)
-	if err != nil {
-		return fmt.Errorf("viper data is not json serializale: %w", err)
+// fieldByIndex is like reflect.Value.FieldByIndex, but dereferences pointers on the way,
+// including the field itself if it's a pointer. It returns the zero Value when a pointer is nil.
+func fieldByIndex(v reflect.Value, index []int) reflect.Value {
+	v = reflect.Indirect(v)
+	for _, i := range index {
+		if !v.IsValid() {
+			break
+		}
+		v = reflect.Indirect(v.Field(i))
+	}
+	return v
+}
+
+func derefAlloc(v reflect.Value) reflect.Value {
+	for v.Kind() == reflect.Pointer {
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		v = v.Elem()
+	}
+	return v
+}
+
+// deepCopy returns an addressable copy of `v` that shares no pointers, slices or maps with it
+func deepCopy(v reflect.Value) reflect.Value {
+	c := reflect.New(v.Type()).Elem()
+	c.Set(v)
+	switch v.Kind() {
+	case reflect.Pointer:
+		if !v.IsNil() {
+			c.Set(deepCopy(v.Elem()).Addr())
+		}
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if c.Field(i).CanSet() {
+				c.Field(i).Set(deepCopy(v.Field(i)))
+			}
+		}
+	case reflect.Slice:
+		if !v.IsNil() {
+			c.Set(reflect.MakeSlice(v.Type(), v.Len(), v.Len()))
+			for i := 0; i < v.Len(); i++ {
+				c.Index(i).Set(deepCopy(v.Index(i)))
+			}
+		}
+	case reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			c.Index(i).Set(deepCopy(v.Index(i)))
+		}
+	case reflect.Interface:
+		if !v.IsNil() {
+			c.Set(deepCopy(v.Elem()))
+		}
+	case reflect.Map:
+		if !v.IsNil() {
+			c.Set(reflect.MakeMapWithSize(v.Type(), v.Len()))
+			iter := v.MapRange()
+			for iter.Next() {
+				c.SetMapIndex(iter.Key(), deepCopy(iter.Value()))
+			}
+		}
 	}
+	return c
+}
 
-	err = json.Unmarshal(jsonBytes, into.Interface())
+// unmarshalViper sets `into`, which is a pointer, to `data` from viper
+func unmarshalViper(into reflect.Value, data any) error {
+	v, err := decodeValue(into.Elem().Type(), data)
 	if err != nil {
-		return fmt.Errorf("unable to parse data %s into type %s: %w", jsonBytes, into.Type(), err)
+		return err
 	}
+	into.Elem().Set(v)
 	return nil
 }
 
-func toJSONName(f reflect.StructField) string {
+func toJSONName(f reflect.StructField, naming NamingStrategy) string {
 	jsonName := f.Tag.Get("json")
 	jsonName, _, _ = strings.Cut(jsonName, ",")
 	if jsonName == "" {
 		jsonName = f.Name
+		if naming != nil {
+			jsonName = naming(f.Name)
+		}
 	}
 	return jsonName
 }
@@ -0,0 +1,47 @@
+package factor3
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Percent is a percentage, written in config files, env vars and flags as `50%` or `12.5%`.
+// The `%` sign is optional, so `50` is also 50%.
+type Percent float64
+
+// ParsePercent parses a percentage, e.g `50%` or `12.5`
+func ParsePercent(s string) (Percent, error) {
+	num := strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(s), "%"))
+	f, err := strconv.ParseFloat(num, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid percentage %q: %w", s, err)
+	}
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return 0, fmt.Errorf("invalid percentage %q", s)
+	}
+	return Percent(f), nil
+}
+
+// Fraction returns the percentage as a fraction of 1, e.g 0.5 for 50%
+func (p Percent) Fraction() float64 {
+	return float64(p) / 100
+}
+
+func (p Percent) String() string {
+	return strconv.FormatFloat(float64(p), 'f', -1, 64) + "%"
+}
+
+func (p Percent) MarshalText() ([]byte, error) {
+	return []byte(p.String()), nil
+}
+
+func (p *Percent) UnmarshalText(text []byte) error {
+	parsed, err := ParsePercent(string(text))
+	if err != nil {
+		return err
+	}
+	*p = parsed
+	return nil
+}
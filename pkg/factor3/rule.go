@@ -0,0 +1,215 @@
+package factor3
+
+import (
+	"fmt"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/google/cel-go/cel"
+	celast "github.com/google/cel-go/common/ast"
+)
+
+var (
+	registeredRules     = map[reflect.Type][]string{}
+	registeredRulesLock sync.RWMutex
+)
+
+// RegisterRule registers a CEL expression (https://cel.dev) that is evaluated by Load() on every struct
+// of type T in the config, including the elements of slices and maps, after it was decoded.
+// Use it for rules that span multiple fields.
+//
+// The struct is available in the expression as `self`, and its fields are named by their config keys:
+//
+//	factor3.RegisterRule[TLSConfig](`!self.enabled || self.cert_file != ""`)
+//	factor3.RegisterRule[Limits](`self.min < self.max`)
+//
+// The expression must evaluate to a bool, and Load() returns a RuleError when it's false.
+// Expressions are compiled by Bind(), which returns a ParseError for invalid ones,
+// so RegisterRule should be called before Bind(), usually from an init() function.
+func RegisterRule[T any](expr string) {
+	t := reflect.TypeFor[T]()
+	registeredRulesLock.Lock()
+	defer registeredRulesLock.Unlock()
+	registeredRules[t] = append(registeredRules[t], expr)
+}
+
+type structRule struct {
+	expr    string
+	program cel.Program
+	// paths are the config keys referenced by the expression
+	paths []string
+	index []int
+}
+
+var celEnv = sync.OnceValues(func() (*cel.Env, error) {
+	return cel.NewEnv(cel.Variable("self", cel.DynType))
+})
+
+// registerRules compiles the rules registered for the type of `v`, which is the struct being visited
+func (l *Loader) registerRules(v reflect.Value) error {
+	rules, err := compileRules(v.Type(), l.jpath)
+	if err != nil {
+		return l.errWithContext(err.Error(), v, l.jpathString())
+	}
+	for _, r := range rules {
+		r.index = slices.Clone(l.index)
+		l.rules = append(l.rules, r)
+	}
+	return nil
+}
+
+// compileRules compiles the rules registered for the struct type `t`, whose config key is `jpath`
+func compileRules(t reflect.Type, jpath []string) ([]structRule, error) {
+	registeredRulesLock.RLock()
+	exprs := registeredRules[t]
+	registeredRulesLock.RUnlock()
+	if len(exprs) == 0 {
+		return nil, nil
+	}
+
+	env, err := celEnv()
+	if err != nil {
+		return nil, fmt.Errorf("creating CEL environment: %w", err)
+	}
+	var rules []structRule
+	for _, expr := range exprs {
+		ast, iss := env.Compile(expr)
+		if iss.Err() != nil {
+			return nil, fmt.Errorf("invalid rule %q: %s", expr, iss.Err())
+		}
+		if out := ast.OutputType(); !out.IsExactType(cel.BoolType) && !out.IsExactType(cel.DynType) {
+			return nil, fmt.Errorf("rule %q must evaluate to bool, not %s", expr, out)
+		}
+		program, err := env.Program(ast)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rule %q: %s", expr, err)
+		}
+		rules = append(rules, structRule{
+			expr:    expr,
+			program: program,
+			paths:   referencedPaths(ast.NativeRep(), jpath),
+		})
+	}
+	return rules, nil
+}
+
+// referencedPaths lists the config keys the expression selects from `self`, prefixed with `jpath`
+func referencedPaths(ast *celast.AST, jpath []string) []string {
+	var paths []string
+	celast.PreOrderVisit(ast.Expr(), celast.NewExprVisitor(func(e celast.Expr) {
+		var sel []string
+		for e.Kind() == celast.SelectKind {
+			sel = append(sel, e.AsSelect().FieldName())
+			e = e.AsSelect().Operand()
+		}
+		if len(sel) == 0 || e.Kind() != celast.IdentKind || e.AsIdent() != "self" {
+			return
+		}
+		slices.Reverse(sel)
+		paths = append(paths, strings.Join(append(slices.Clone(jpath), sel...), "."))
+	}))
+
+	// `self.a.b` visits both `self.a.b` and `self.a`, only the longest is interesting
+	paths = slices.DeleteFunc(paths, func(p string) bool {
+		return slices.ContainsFunc(paths, func(other string) bool { return strings.HasPrefix(other, p+".") })
+	})
+	slices.Sort(paths)
+	return slices.Compact(paths)
+}
+
+// evalRules evaluates the rules against `root`, returning a RuleError for every rule that didn't pass
+func (l *Loader) evalRules(root reflect.Value) []error {
+	var errs []error
+	for _, r := range l.rules {
+		v := fieldByIndex(root, r.index)
+		if !v.IsValid() {
+			continue // under an optional field that is not set
+		}
+		if err := r.eval(v, r.paths, l.naming); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	for _, er := range l.elementRules {
+		collection := fieldByIndex(root, er.index)
+		if !collection.IsValid() {
+			continue
+		}
+		for _, name := range elementNames(collection) {
+			v := er.leaf.valueIn(elementByName(collection, name))
+			if !v.IsValid() {
+				continue
+			}
+			prefix := strings.Join(append([]string{er.viperPath, name}, er.leaf.keys...), ".")
+			paths := make([]string, len(er.rule.paths))
+			for i, p := range er.rule.paths {
+				paths[i] = prefix + "." + p
+			}
+			if err := er.rule.eval(v, paths, l.naming); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	return errs
+}
+
+// eval evaluates the rule against the struct `v`, returning a RuleError if it didn't pass
+func (r structRule) eval(v reflect.Value, paths []string, naming NamingStrategy) error {
+	out, _, err := r.program.Eval(map[string]any{"self": plainValue(v, naming)})
+	if err != nil {
+		return RuleError{Rule: r.expr, Paths: paths, Err: err}
+	}
+	if passed, ok := out.Value().(bool); !ok {
+		return RuleError{Rule: r.expr, Paths: paths, Err: fmt.Errorf("evaluated to %v instead of a bool", out)}
+	} else if !passed {
+		return RuleError{Rule: r.expr, Paths: paths}
+	}
+	return nil
+}
+
+// elementRule is a rule of a struct in the elements of a slice or map of structs,
+// whose paths are relative to that struct
+type elementRule struct {
+	viperPath string
+	index     []int
+	// leaf locates the struct in the element
+	leaf elementLeaf
+	rule structRule
+}
+
+// compileElementRules compiles the rules of the struct type `t` and of the structs in it, for the elements
+// of the slice or map at `viperPath` and `index`. `keys` and `leafIndex` locate `t` in the element.
+func (l *Loader) compileElementRules(t reflect.Type, viperPath string, index []int, keys []string, leafIndex []int) ([]elementRule, error) {
+	rules, err := compileRules(t, nil)
+	if err != nil {
+		return nil, err
+	}
+	var ers []elementRule
+	for _, r := range rules {
+		ers = append(ers, elementRule{viperPath: viperPath, index: index, leaf: elementLeaf{keys: keys, index: leafIndex}, rule: r})
+	}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if skipField(f) {
+			continue
+		}
+		ft := f.Type
+		for ft.Kind() == reflect.Pointer && !hasStringForm(ft) {
+			ft = ft.Elem()
+		}
+		if ft.Kind() != reflect.Struct || hasStringForm(ft) {
+			continue
+		}
+		fkeys := keys
+		if !isSquashed(f) {
+			fkeys = append(slices.Clone(keys), l.keyName(f))
+		}
+		nested, err := l.compileElementRules(ft, viperPath, index, fkeys, append(slices.Clone(leafIndex), i))
+		if err != nil {
+			return nil, err
+		}
+		ers = append(ers, nested...)
+	}
+	return ers, nil
+}
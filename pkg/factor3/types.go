@@ -0,0 +1,169 @@
+package factor3
+
+import (
+	"encoding"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"reflect"
+	"regexp"
+	"time"
+
+	"github.com/spf13/pflag"
+)
+
+// wellKnownType is a type from the standard library that is written as a human readable string
+// in config files, env vars and flags, instead of its Go representation
+type wellKnownType struct {
+	// name is the type of the flag, as shown in the flags usage
+	name   string
+	parse  func(s string) (any, error)
+	format func(v any) string
+}
+
+var wellKnownTypes = map[reflect.Type]wellKnownType{
+	reflect.TypeFor[time.Duration](): {
+		name:   "duration",
+		parse:  func(s string) (any, error) { return time.ParseDuration(s) },
+		format: func(v any) string { return v.(time.Duration).String() },
+	},
+	reflect.TypeFor[time.Time](): {
+		name:   "time",
+		parse:  func(s string) (any, error) { return time.Parse(time.RFC3339, s) },
+		format: func(v any) string { return v.(time.Time).Format(time.RFC3339) },
+	},
+	reflect.TypeFor[net.IP](): {
+		name: "ip",
+		parse: func(s string) (any, error) {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, errors.New("invalid IP address")
+			}
+			return ip, nil
+		},
+		format: func(v any) string { return v.(net.IP).String() },
+	},
+	reflect.TypeFor[net.IPNet](): {
+		name: "ipNet",
+		parse: func(s string) (any, error) {
+			_, n, err := net.ParseCIDR(s)
+			if err != nil {
+				return nil, err
+			}
+			return *n, nil
+		},
+		format: func(v any) string { n := v.(net.IPNet); return n.String() },
+	},
+	reflect.TypeFor[url.URL](): {
+		name: "url",
+		parse: func(s string) (any, error) {
+			u, err := url.Parse(s)
+			if err != nil {
+				return nil, err
+			}
+			return *u, nil
+		},
+		format: func(v any) string { u := v.(url.URL); return u.String() },
+	},
+	reflect.TypeFor[regexp.Regexp](): {
+		name: "regexp",
+		parse: func(s string) (any, error) {
+			re, err := regexp.Compile(s)
+			if err != nil {
+				return nil, err
+			}
+			return *re, nil
+		},
+		format: func(v any) string { re := v.(regexp.Regexp); return re.String() },
+	},
+}
+
+var (
+	textUnmarshalerType = reflect.TypeFor[encoding.TextUnmarshaler]()
+	pflagValueType      = reflect.TypeFor[pflag.Value]()
+)
+
+// isTextType reports whether `t` parses itself from text, by implementing
+// encoding.TextUnmarshaler or pflag.Value (on a pointer receiver)
+func isTextType(t reflect.Type) bool {
+	p := reflect.PointerTo(t)
+	return p.Implements(textUnmarshalerType) || p.Implements(pflagValueType)
+}
+
+// hasStringForm reports whether values of `t` are loaded as a whole, from their string form
+// or by a registered decoder, as opposed to basic kinds and structs
+func hasStringForm(t reflect.Type) bool {
+	if _, ok := wellKnownTypes[t]; ok {
+		return true
+	}
+	if _, ok := lookupDecoder(t); ok {
+		return true
+	}
+	return isTextType(t)
+}
+
+// formatString is the inverse of parseString for types that have a string form
+func formatString(v reflect.Value) string {
+	if v.IsZero() {
+		return ""
+	}
+	if wk, ok := wellKnownTypes[v.Type()]; ok {
+		return wk.format(v.Interface())
+	}
+	p := reflect.New(v.Type())
+	p.Elem().Set(v)
+	switch u := p.Interface().(type) {
+	case encoding.TextMarshaler:
+		if b, err := u.MarshalText(); err == nil {
+			return string(b)
+		}
+	case fmt.Stringer:
+		return u.String()
+	}
+	return fmt.Sprint(v.Interface())
+}
+
+// newFlagValue creates a flag for types that have a string form, with `v` as the default.
+// Types that implement pflag.Value are used directly.
+func newFlagValue(v reflect.Value) pflag.Value {
+	p := reflect.New(v.Type())
+	p.Elem().Set(v)
+	if wk, ok := wellKnownTypes[v.Type()]; ok {
+		return &parsedValue{value: p.Elem(), name: wk.name}
+	}
+	if _, ok := lookupDecoder(v.Type()); ok {
+		return &parsedValue{value: p.Elem(), name: v.Type().Name()}
+	}
+	if pv, ok := p.Interface().(pflag.Value); ok {
+		return pv
+	}
+	return &parsedValue{value: p.Elem(), name: v.Type().Name()}
+}
+
+// parsedValue is a pflag.Value for types that are parsed from strings by parseString()
+type parsedValue struct {
+	value reflect.Value
+	name  string
+	// raw is the string that was last Set(). It's what viper reads from the flag,
+	// which might not be what formatString() returns (e.g SecretString is masked)
+	raw *string
+}
+
+func (pv *parsedValue) Type() string { return pv.name }
+func (pv *parsedValue) String() string {
+	if pv.raw != nil {
+		return *pv.raw
+	}
+	return formatString(pv.value)
+}
+
+func (pv *parsedValue) Set(s string) error {
+	v, err := parseString(pv.value.Type(), s)
+	if err != nil {
+		return err
+	}
+	pv.value.Set(v)
+	pv.raw = &s
+	return nil
+}
@@ -0,0 +1,78 @@
+package factor3
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/spf13/pflag"
+)
+
+var (
+	registeredFieldDocs     = map[reflect.Type]map[string]string{}
+	registeredFieldDocsLock sync.RWMutex
+)
+
+// RegisterFieldDocs registers descriptions for the fields of struct T, by field name.
+// They are used as the usage of flags for fields without a `usage:"..."` tag.
+//
+// It's meant to be called from code generated by factor3gen, which extracts the doc comments of the fields:
+//
+//	//go:generate go run github.com/drornir/factor3/cmd/factor3gen $GOFILE
+func RegisterFieldDocs[T any](docs map[string]string) {
+	t := reflect.TypeFor[T]()
+	registeredFieldDocsLock.Lock()
+	defer registeredFieldDocsLock.Unlock()
+	if registeredFieldDocs[t] == nil {
+		registeredFieldDocs[t] = map[string]string{}
+	}
+	for name, doc := range docs {
+		registeredFieldDocs[t][name] = doc
+	}
+}
+
+// description of a field is taken from the `usage:"..."` tag, `desc:"..."` tag,
+// or from the docs registered with RegisterFieldDocs(), in that order
+func (f visitedField) description() string {
+	if d, ok := f.Tag.Lookup("usage"); ok {
+		return d
+	}
+	if d, ok := f.Tag.Lookup("desc"); ok {
+		return d
+	}
+	if f.parent == nil {
+		return ""
+	}
+	registeredFieldDocsLock.RLock()
+	defer registeredFieldDocsLock.RUnlock()
+	return registeredFieldDocs[f.parent][f.Name]
+}
+
+// flagUsage is a flag registered by Bind(), whose usage is refreshed when the env prefix changes
+type flagUsage struct {
+	flag        *pflag.Flag
+	description string
+	viperPath   string
+}
+
+// formatUsage returns the usage line of a flag, which also tells the other ways to set the same value
+func formatUsage(description, envName, viperPath string) string {
+	sources := fmt.Sprintf("(env %s, config key %s)", envName, viperPath)
+	if description == "" {
+		return sources
+	}
+	return strings.TrimSuffix(description, ".") + " " + sources
+}
+
+func (l *Loader) setFlagUsage(name, description string) {
+	f := l.pflagset.Lookup(name)
+	if f == nil {
+		return
+	}
+	if l.viper == nil {
+		f.Usage = description
+		return
+	}
+	l.viper.state.trackUsage(flagUsage{flag: f, description: description, viperPath: l.jpathString()})
+}
@@ -0,0 +1,234 @@
+package factor3
+
+import (
+	"cmp"
+	"fmt"
+	"net"
+	"net/url"
+	"reflect"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// fieldValidation holds the rules from the `validate:"..."` tag of a single field, e.g `validate:"min=1,max=10"`.
+// `regexp=` has to be the last rule, since it can contain commas.
+// Zero values are validated only when a source sets them, use `required:"true"` for missing values.
+type fieldValidation struct {
+	viperPath string
+	index     []int
+	rules     []validationRule
+}
+
+type validationRule struct {
+	// tag is the rule as written in the tag, e.g "oneof=debug info"
+	tag   string
+	check func(v reflect.Value) error
+}
+
+func (l *Loader) registerValidation(v reflect.Value) error {
+	tag, ok := l.currentField().Tag.Lookup("validate")
+	if !ok || tag == "" {
+		return nil
+	}
+	rules, err := parseValidateTag(v.Type(), tag)
+	if err != nil {
+		return l.errWithContext(fmt.Sprintf("invalid validate tag %q: %s", tag, err), v, l.jpathString())
+	}
+	l.validations = append(l.validations, fieldValidation{
+		viperPath: l.jpathString(),
+		index:     slices.Clone(l.index),
+		rules:     rules,
+	})
+	return nil
+}
+
+// validate runs all the validation rules against `root`,
+// returning a FieldError for every rule that failed
+func (l *Loader) validate(root reflect.Value) []error {
+	var errs []error
+	for i := len(l.validations) - 1; i >= 0; i-- {
+		fv := l.validations[i]
+		v := fieldByIndex(root, fv.index)
+		if !v.IsValid() || v.IsZero() && !l.viper.IsSet(fv.viperPath) {
+			continue
+		}
+		for _, r := range fv.rules {
+			if err := r.check(v); err != nil {
+				errs = append(errs, FieldError{
+					Path:  fv.viperPath,
+					Rule:  r.tag,
+					Value: v.Interface(),
+					Err:   err,
+				})
+			}
+		}
+	}
+	return errs
+}
+
+func parseValidateTag(t reflect.Type, tag string) ([]validationRule, error) {
+	var rules []validationRule
+	for tag != "" {
+		var ruleTag string
+		if strings.HasPrefix(tag, "regexp=") {
+			ruleTag, tag = tag, ""
+		} else {
+			ruleTag, tag, _ = strings.Cut(tag, ",")
+		}
+		name, arg, _ := strings.Cut(ruleTag, "=")
+		check, err := newValidationCheck(t, name, arg)
+		if err != nil {
+			return nil, fmt.Errorf("rule %q: %w", ruleTag, err)
+		}
+		rules = append(rules, validationRule{tag: ruleTag, check: check})
+	}
+	return rules, nil
+}
+
+func newValidationCheck(t reflect.Type, name, arg string) (func(v reflect.Value) error, error) {
+	switch name {
+	case "min", "max":
+		return newBoundCheck(t, name == "min", arg)
+	}
+
+	// the rest of the rules apply to every element of slices and maps
+	if t.Kind() == reflect.Slice || t.Kind() == reflect.Array || t.Kind() == reflect.Map {
+		check, err := newValidationCheck(t.Elem(), name, arg)
+		if err != nil {
+			return nil, err
+		}
+		return eachElement(check), nil
+	}
+
+	switch name {
+	case "oneof":
+		options := strings.Fields(arg)
+		if len(options) == 0 {
+			return nil, fmt.Errorf("oneof needs at least one option")
+		}
+		return func(v reflect.Value) error {
+			if !slices.Contains(options, fmt.Sprint(plainValue(v, nil))) {
+				return fmt.Errorf("must be one of %s", strings.Join(options, ", "))
+			}
+			return nil
+		}, nil
+	case "regexp":
+		if t.Kind() != reflect.String {
+			return nil, fmt.Errorf("regexp can only be applied to strings, not %s", t)
+		}
+		re, err := regexp.Compile(arg)
+		if err != nil {
+			return nil, err
+		}
+		return func(v reflect.Value) error {
+			if !re.MatchString(v.String()) {
+				return fmt.Errorf("must match %s", re)
+			}
+			return nil
+		}, nil
+	case "url":
+		if t.Kind() != reflect.String {
+			return nil, fmt.Errorf("url can only be applied to strings, not %s", t)
+		}
+		return func(v reflect.Value) error {
+			u, err := url.Parse(v.String())
+			if err != nil {
+				return err
+			}
+			if u.Scheme == "" || u.Host == "" {
+				return fmt.Errorf("must be an absolute url")
+			}
+			return nil
+		}, nil
+	case "hostport":
+		if t.Kind() != reflect.String {
+			return nil, fmt.Errorf("hostport can only be applied to strings, not %s", t)
+		}
+		return func(v reflect.Value) error {
+			_, port, err := net.SplitHostPort(v.String())
+			if err != nil {
+				return err
+			}
+			if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+				return fmt.Errorf("invalid port %q", port)
+			}
+			return nil
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown rule %q", name)
+	}
+}
+
+// newBoundCheck creates the check for `min` and `max`. Numbers (and durations) are compared by value,
+// while strings, slices and maps are compared by length.
+func newBoundCheck(t reflect.Type, isMin bool, arg string) (func(v reflect.Value) error, error) {
+	word := "at most"
+	if isMin {
+		word = "at least"
+	}
+	outOfBounds := func(c int) bool {
+		return isMin && c < 0 || !isMin && c > 0
+	}
+
+	switch t.Kind() {
+	case reflect.String, reflect.Slice, reflect.Array, reflect.Map:
+		bound, err := strconv.Atoi(arg)
+		if err != nil {
+			return nil, err
+		}
+		return func(v reflect.Value) error {
+			if outOfBounds(v.Len() - bound) {
+				return fmt.Errorf("length must be %s %d", word, bound)
+			}
+			return nil
+		}, nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		bound, err := parseString(t, arg)
+		if err != nil {
+			return nil, err
+		}
+		return func(v reflect.Value) error {
+			if outOfBounds(compareNumbers(v, bound)) {
+				return fmt.Errorf("must be %s %v", word, bound)
+			}
+			return nil
+		}, nil
+	default:
+		return nil, fmt.Errorf("cannot be applied to %s", t)
+	}
+}
+
+func compareNumbers(a, b reflect.Value) int {
+	switch a.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return cmp.Compare(a.Int(), b.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return cmp.Compare(a.Uint(), b.Uint())
+	default:
+		return cmp.Compare(a.Float(), b.Float())
+	}
+}
+
+func eachElement(check func(v reflect.Value) error) func(v reflect.Value) error {
+	return func(v reflect.Value) error {
+		if v.Kind() == reflect.Map {
+			iter := v.MapRange()
+			for iter.Next() {
+				if err := check(iter.Value()); err != nil {
+					return fmt.Errorf("key %v: %w", iter.Key(), err)
+				}
+			}
+			return nil
+		}
+		for i := 0; i < v.Len(); i++ {
+			if err := check(v.Index(i)); err != nil {
+				return fmt.Errorf("index %d: %w", i, err)
+			}
+		}
+		return nil
+	}
+}
@@ -0,0 +1,198 @@
+package factor3
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"maps"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/spf13/pflag"
+)
+
+var (
+	registeredVariants     = map[reflect.Type]map[string]reflect.Type{}
+	registeredVariantsLock sync.RWMutex
+)
+
+// RegisterVariant registers the type of `variant` as a concrete type of fields of the interface type I, e.g
+//
+//	factor3.RegisterVariant[Storage]("s3", S3Config{})
+//
+// The `type` key of the section (or the key in the `discriminator:"..."` tag) picks the type, or leaves the field nil.
+// Fields with the same name in several variants must have the same type. It panics if `name` is already registered.
+func RegisterVariant[I any](name string, variant I) {
+	it := reflect.TypeFor[I]()
+	if it.Kind() != reflect.Interface {
+		panic(fmt.Sprintf("factor3.RegisterVariant: %s is not an interface", it))
+	}
+	vt := reflect.TypeOf(variant)
+	if vt == nil {
+		panic(fmt.Sprintf("factor3.RegisterVariant: variant %q of %s is nil", name, it))
+	}
+	registeredVariantsLock.Lock()
+	defer registeredVariantsLock.Unlock()
+	if registeredVariants[it] == nil {
+		registeredVariants[it] = map[string]reflect.Type{}
+	}
+	if _, ok := registeredVariants[it][name]; ok {
+		panic(fmt.Sprintf("factor3.RegisterVariant: variant %q of %s is already registered", name, it))
+	}
+	registeredVariants[it][name] = vt
+}
+
+func lookupVariants(t reflect.Type) map[string]reflect.Type {
+	registeredVariantsLock.RLock()
+	defer registeredVariantsLock.RUnlock()
+	return maps.Clone(registeredVariants[t])
+}
+
+// variantStruct is the struct type of a variant, which is registered either as a struct or as a pointer to one
+func variantStruct(vt reflect.Type) reflect.Type {
+	if vt.Kind() == reflect.Pointer {
+		return vt.Elem()
+	}
+	return vt
+}
+
+// visitVariants registers the discriminator of the interface `v`, and visits each of its variants with its own Loader
+func (l *Loader) visitVariants(v reflect.Value) error {
+	variants := lookupVariants(v.Type())
+	if len(variants) == 0 {
+		return l.errWithContext(fmt.Sprintf("unsupported type %s, register its variants with RegisterVariant()", v.Type()), v, l.jpathString())
+	}
+	names := slices.Sorted(maps.Keys(variants))
+	for _, name := range names {
+		if vt := variantStruct(variants[name]); vt.Kind() != reflect.Struct {
+			return l.errWithContext(fmt.Sprintf("variant %q must be a struct, not %s", name, vt), v, l.jpathString())
+		}
+	}
+
+	disc := cmp.Or(l.currentField().Tag.Get("discriminator"), "type")
+	viperPath := l.jpathString()
+	discPath := viperPath + "." + disc
+	l.viperPaths = append(l.viperPaths, discPath)
+	if l.viper != nil && len(l.envScopes) > 0 {
+		scope := l.envScopes[len(l.envScopes)-1]
+		scopePath := strings.Join(append(slices.Clone(l.jpath[scope.depth:]), disc), ".")
+		b := envBinding{scoped: true, scopePrefix: scope.prefix, scopePath: scopePath}
+		l.viper.state.addEnvBinding(discPath, b)
+	}
+	if l.pflagset != nil && l.hasFlag() {
+		flagName := l.fpathString() + l.flagSeparator + disc
+		if l.pflagset.Lookup(flagName) != nil {
+			return l.errWithContext(fmt.Sprintf("flag --%s is already defined", flagName), v, viperPath)
+		}
+		description := fmt.Sprintf("Type of %s, one of %s", viperPath, strings.Join(names, ", "))
+		f := l.pflagset.VarPF(newFlagValue(reflect.New(reflect.TypeFor[string]()).Elem()), flagName, "", description)
+		l.viperPathByPFlagName[flagName] = discPath
+		if l.viper != nil {
+			l.viper.state.trackUsage(flagUsage{flag: f, description: description, viperPath: discPath})
+		}
+	}
+
+	sharedFlags := map[string]*sharedFlag{}
+	loaders := map[string]*Loader{}
+	for _, name := range names {
+		vl := l.variantLoader(sharedFlags)
+		vl.variantDefaults = reflect.New(variantStruct(variants[name])).Elem()
+		applyDefaulters(vl.variantDefaults)
+		if err := vl.visit(vl.variantDefaults); err != nil {
+			return err
+		}
+		l.viperPaths = append(l.viperPaths, vl.viperPaths...)
+		loaders[name] = vl
+	}
+
+	index := slices.Clone(l.index)
+	l.loaders = append(l.loaders, func(root reflect.Value) error {
+		fv := fieldByIndex(root, index)
+		if !fv.IsValid() {
+			return nil
+		}
+		name := l.viper.GetString(discPath)
+		if name == "" {
+			fv.Set(reflect.Zero(fv.Type()))
+			return nil
+		}
+		vt, ok := variants[name]
+		if !ok {
+			return l.errWithContext(fmt.Sprintf("unknown %s %q, must be one of %s", disc, name, strings.Join(names, ", ")), fv, discPath)
+		}
+		p := reflect.New(variantStruct(vt))
+		p.Elem().Set(deepCopy(loaders[name].variantDefaults))
+		if errs := loaders[name].loadVariant(p.Elem()); len(errs) > 0 {
+			return errors.Join(errs...)
+		}
+		if vt.Kind() == reflect.Pointer {
+			fv.Set(p)
+		} else {
+			fv.Set(p.Elem())
+		}
+		return nil
+	})
+	return nil
+}
+
+// variantLoader creates a Loader for a variant of the interface field being visited
+func (l *Loader) variantLoader(sharedFlags map[string]*sharedFlag) *Loader {
+	vl := newLoader(l.viper, l.pflagset)
+	vl.naming = l.naming
+	vl.autoFlags = l.autoFlags
+	vl.flagSeparator = l.flagSeparator
+	vl.jpath = slices.Clone(l.jpath)
+	vl.fpath = slices.Clone(l.fpath)
+	vl.fields = slices.Clone(l.fields)
+	vl.envScopes = slices.Clone(l.envScopes)
+	vl.viperPathByPFlagName = l.viperPathByPFlagName
+	vl.elementFlagNames = l.elementFlagNames
+	vl.sharedFlags = sharedFlags
+	return vl
+}
+
+// sharedFlag is a flag of a field that several variants have, registered by the first of them
+type sharedFlag struct {
+	// def is the default of the flag, until a variant with another default resets it
+	def reflect.Value
+}
+
+// shareFlag checks the current field against the flag `sf` of another variant.
+// Variants that disagree on the default leave the flag with the zero value.
+func (l *Loader) shareFlag(sf *sharedFlag, v reflect.Value) error {
+	flagsPath := l.fpathString()
+	f := l.pflagset.Lookup(flagsPath)
+	if f == nil {
+		return nil
+	}
+	if sf.def.Type() != v.Type() {
+		return l.errWithContext(fmt.Sprintf("flag --%s is %s in another variant, not %s", flagsPath, sf.def.Type(), v.Type()), v, l.jpathString())
+	}
+	if !sf.def.IsZero() && !reflect.DeepEqual(sf.def.Interface(), v.Interface()) {
+		zero := pflag.NewFlagSet(flagsPath, pflag.ContinueOnError)
+		addPflag(zero, reflect.New(v.Type()).Elem(), flagsPath, "", "")
+		f.Value = zero.Lookup(flagsPath).Value
+		f.DefValue = zero.Lookup(flagsPath).DefValue
+		sf.def = reflect.New(v.Type()).Elem()
+	}
+	return nil
+}
+
+// loadVariant loads and validates the struct `v` of a variant, which starts with the defaults of the variant.
+// Hooks are called by the Loader of the whole config.
+func (l *Loader) loadVariant(v reflect.Value) []error {
+	l.resolveOptionals(v)
+	var errs []error
+	for _, loader := range l.loaders {
+		if err := loader(v); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	errs = append(errs, l.checkRequired(v)...)
+	errs = append(errs, l.validate(v)...)
+	errs = append(errs, l.checkElements(v)...)
+	errs = append(errs, l.evalRules(v)...)
+	return errs
+}
@@ -1,23 +1,51 @@
 package factor3
 
 import (
+	"bytes"
+	"cmp"
 	"context"
 	"errors"
 	"fmt"
+	"io/fs"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
+	"sync"
 
+	"github.com/fsnotify/fsnotify"
+	"github.com/spf13/afero"
 	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
 
 	"github.com/drornir/factor3/pkg/log"
 )
 
+// Viper is a viper instance together with what factor3 knows about it, which InitializeViper() and Bind() share.
+// Create it with NewViper(), and use it like the viper instance it embeds.
+type Viper struct {
+	*viper.Viper
+	state *viperState
+}
+
+// NewViper wraps `v` for InitializeViper() and Bind()
+func NewViper(v *viper.Viper) *Viper {
+	return &Viper{Viper: v, state: &viperState{}}
+}
+
 type InitArgs struct {
-	Viper       *viper.Viper
+	Viper       *Viper
 	ProgramName string
 	CfgFile     string
+	// Defaults is an optional file system (usually an embed.FS) holding a config file
+	// that is loaded beneath config files, env and flags, and above `default:"..."` tags and SetDefaults().
+	// Every key in it must exist in the struct passed to Bind().
+	Defaults fs.FS
+	// DefaultsFile is the path of the defaults file inside Defaults. Defaults to "defaults.yaml"
+	DefaultsFile string
+	// EnvSeparator joins the keys of nested fields in env var names. Defaults to "_".
+	// Use "__" when keys contain underscores, e.g LOG__LONGER_STRING for log.longer_string
+	EnvSeparator string
 }
 
 func InitializeViper(a InitArgs) error {
@@ -25,7 +53,15 @@ func InitializeViper(a InitArgs) error {
 	a.Viper.SetEnvPrefix(a.ProgramName)
 	a.Viper.AllowEmptyEnv(true)
 	a.Viper.AutomaticEnv()
-	a.Viper.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
+	if err := a.Viper.SetEnvSeparator(cmp.Or(a.EnvSeparator, "_")); err != nil {
+		return err
+	}
+
+	if a.Defaults != nil {
+		if err := readDefaults(a.Viper, a.Defaults, a.DefaultsFile); err != nil {
+			return fmt.Errorf("reading embedded defaults: %w", err)
+		}
+	}
 
 	if a.CfgFile != "" {
 		a.Viper.SetConfigFile(a.CfgFile)
@@ -39,24 +75,340 @@ func InitializeViper(a InitArgs) error {
 			configHome = filepath.Join(home, ".config", a.ProgramName)
 		}
 
-		a.Viper.AddConfigPath(configHome)
-		a.Viper.SetConfigName("config")
+		cfgFile, ok := findConfigFile(a.Viper.state.configFs(), configHome, "config")
+		if !ok {
+			return nil
+		}
+		a.Viper.SetConfigFile(cfgFile)
 		a.Viper.WatchConfig()
 	}
+	// viper calls it after reading a changed config file, see WatchConfig()
+	a.Viper.Viper.OnConfigChange(a.Viper.configChanged)
 
-	// If a config file is found, read it in.
-	if err := a.Viper.ReadInConfig(); err != nil {
-		if !errors.Is(err, viper.ConfigFileNotFoundError{}) {
-			return fmt.Errorf("reading in config file using viper: %w", err)
+	if err := a.Viper.readConfig(); err != nil {
+		return fmt.Errorf("reading in config file: %w", err)
+	}
+	return nil
+}
+
+// findConfigFile looks for `name` in `dir` with any of the extensions viper supports, e.g config.yaml
+func findConfigFile(fsys afero.Fs, dir, name string) (string, bool) {
+	for _, ext := range viper.SupportedExts {
+		path := filepath.Join(dir, name+"."+ext)
+		if ok, _ := afero.Exists(fsys, path); ok {
+			return path, true
 		}
-		// fmt.Fprintln(os.Stderr, err.Error())
-	} else {
-		// fmt.Fprintln(os.Stderr, "Read in config file:", a.Viper.ConfigFileUsed())
 	}
+	return "", false
+}
+
+// readConfig reads the config file and passes it to viper, so factor3 keeps the case of its keys
+// from the same bytes viper read
+func (v *Viper) readConfig() error {
+	name := v.ConfigFileUsed()
+	b, err := afero.ReadFile(v.state.configFs(), name)
+	if err != nil {
+		return err
+	}
+	if err := v.Viper.ReadConfig(bytes.NewReader(b)); err != nil {
+		return err
+	}
+	raw, err := parseRawConfig(name, b)
+	if err != nil {
+		return err
+	}
+	v.state.lock.Lock()
+	defer v.state.lock.Unlock()
+	v.state.rawConfig = raw
+	return nil
+}
+
+func (v *Viper) configChanged(in fsnotify.Event) {
+	if err := v.readConfig(); err != nil {
+		log.GG().E(context.TODO(), "reading changed config file", "file_name", in.Name, "error", err)
+	}
+	v.state.lock.Lock()
+	run := v.state.onConfigChange
+	v.state.lock.Unlock()
+	if run != nil {
+		run(in)
+	}
+}
+
+// OnConfigChange sets the function that is called when the config file changes, like viper.OnConfigChange(),
+// after factor3 read the file again too
+func (v *Viper) OnConfigChange(run func(in fsnotify.Event)) {
+	v.state.lock.Lock()
+	defer v.state.lock.Unlock()
+	v.state.onConfigChange = run
+}
 
+// SetFs sets the file system of config files, like viper.SetFs(), and lets factor3 read them from it too
+func (v *Viper) SetFs(fs afero.Fs) {
+	v.state.lock.Lock()
+	v.state.fs = fs
+	v.state.lock.Unlock()
+	v.Viper.SetFs(fs)
+}
+
+// SetEnvPrefix sets the prefix of env vars, like viper.SetEnvPrefix(), and lets factor3 know about it.
+// InitializeViper() calls it with the ProgramName, but when Bind() is called first, calling it before Bind()
+// makes the env var names in the flags usage correct even if InitializeViper() never runs (e.g with --help).
+func (v *Viper) SetEnvPrefix(prefix string) {
+	v.state.setEnvPrefix(prefix)
+	v.Viper.SetEnvPrefix(prefix)
+}
+
+// SetEnvSeparator sets the separator of nested keys in env var names, like viper.SetEnvKeyReplacer(), and lets factor3
+// know about it. InitializeViper() calls it with InitArgs.EnvSeparator. It fails to change it after Load().
+func (v *Viper) SetEnvSeparator(sep string) error {
+	if err := v.state.setEnvSeparator(sep); err != nil {
+		return err
+	}
+	v.SetEnvKeyReplacer(strings.NewReplacer(".", sep))
+	return nil
+}
+
+func readDefaults(v *Viper, fsys fs.FS, name string) error {
+	if name == "" {
+		name = "defaults.yaml"
+	}
+	b, err := fs.ReadFile(fsys, name)
+	if err != nil {
+		return err
+	}
+	dv := viper.New()
+	dv.SetConfigType(strings.TrimPrefix(filepath.Ext(name), "."))
+	if err := dv.ReadConfig(bytes.NewReader(b)); err != nil {
+		return fmt.Errorf("parsing %q: %w", name, err)
+	}
+
+	keys := dv.AllKeys()
+	for _, k := range keys {
+		// overrides the `default:"..."` tags when Bind() was called first
+		v.SetDefault(k, dv.Get(k))
+	}
+	raw, err := parseRawConfig(name, b)
+	if err != nil {
+		return err
+	}
+
+	st := v.state
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	st.rawDefaults = raw
+	st.defaultKeys = append(st.defaultKeys, keys...)
+	return st.checkDefaults()
+}
+
+// viperState is what factor3 remembers about a viper instance between
+// InitializeViper() and Bind(), which can be called in any order.
+type viperState struct {
+	// rawConfig and rawDefaults are the config file and the embedded defaults with the case of their keys
+	rawConfig    map[string]any
+	rawDefaults  map[string]any
+	envPrefix    string
+	envSeparator string
+	// envBindings are the fields with `env:"..."` tags or under an `envPrefix:"..."` tag, by viper path
+	envBindings map[string]envBinding
+	// envBound are the paths of envBindings already bound in viper
+	envBound    map[string]bool
+	defaultKeys []string
+	boundKeys   []string
+	flagUsages  []flagUsage
+	// fs is the file system of config files, see Viper.SetFs()
+	fs             afero.Fs
+	onConfigChange func(in fsnotify.Event)
+
+	lock sync.Mutex
+}
+
+func (st *viperState) configFs() afero.Fs {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	if st.fs == nil {
+		return afero.NewOsFs()
+	}
+	return st.fs
+}
+
+func (st *viperState) setEnvPrefix(prefix string) {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	st.envPrefix = prefix
+	st.refreshUsagesLocked()
+}
+
+func (st *viperState) setEnvSeparator(sep string) error {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	if len(st.envBound) > 0 && cmp.Or(sep, "_") != st.separator() {
+		// viper can't unbind the env vars named with the old separator
+		return fmt.Errorf("can't change the env separator to %q after Load()", sep)
+	}
+	st.envSeparator = sep
+	st.refreshUsagesLocked()
 	return nil
 }
 
+func (st *viperState) envKeySeparator() string {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	return st.separator()
+}
+
+func (st *viperState) separator() string {
+	return cmp.Or(st.envSeparator, "_")
+}
+
+func (st *viperState) refreshUsagesLocked() {
+	for _, fu := range st.flagUsages {
+		fu.flag.Usage = formatUsage(fu.description, st.envNameLocked(fu.viperPath), fu.viperPath)
+	}
+}
+
+// trackUsage sets the usage of the flag, and keeps it up to date when the env prefix or separator is set
+func (st *viperState) trackUsage(fu flagUsage) {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	st.flagUsages = append(st.flagUsages, fu)
+	fu.flag.Usage = formatUsage(fu.description, st.envNameLocked(fu.viperPath), fu.viperPath)
+}
+
+// envBinding names the env vars of a field besides the one derived from its path
+type envBinding struct {
+	// scoped is set for fields under a struct with an `envPrefix:"..."` tag. Their env var is
+	// scopePrefix followed by scopePath, the path of the field relative to that struct.
+	scoped      bool
+	scopePrefix string
+	scopePath   string
+	// aliases are the names from the `env:"..."` tag
+	aliases []string
+}
+
+func (b envBinding) names(sep string) []string {
+	if !b.scoped {
+		return b.aliases
+	}
+	scopedName := b.scopePrefix + strings.ToUpper(strings.ReplaceAll(b.scopePath, ".", sep))
+	return append([]string{scopedName}, b.aliases...)
+}
+
+// addEnvBinding records the env vars of `b` for `viperPath`. bindEnvs() hands them to viper.
+func (st *viperState) addEnvBinding(viperPath string, b envBinding) {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	if st.envBindings == nil {
+		st.envBindings = map[string]envBinding{}
+	}
+	st.envBindings[viperPath] = b
+}
+
+// bindEnvs makes viper look up the env vars of the recorded bindings, in order, after the env var derived
+// from the path. It binds each path once, and only when loading, since the names depend on the separator.
+func (st *viperState) bindEnvs(v *viper.Viper) error {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	for path, b := range st.envBindings {
+		if st.envBound[path] {
+			continue
+		}
+		if err := v.BindEnv(append([]string{path}, b.names(st.separator())...)...); err != nil {
+			return fmt.Errorf("binding env vars of %q: %w", path, err)
+		}
+		if st.envBound == nil {
+			st.envBound = map[string]bool{}
+		}
+		st.envBound[path] = true
+	}
+	return nil
+}
+
+// envName is the name of the env var of `viperPath` shown to users,
+// or the names viper looks up joined with " or " when there are several.
+func (st *viperState) envName(viperPath string) string {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	return st.envNameLocked(viperPath)
+}
+
+// envNames are the names of the env vars viper looks up for `viperPath`, in order
+func (st *viperState) envNames(viperPath string) []string {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	return st.envNamesLocked(viperPath)
+}
+
+func (st *viperState) envNameLocked(viperPath string) string {
+	return strings.Join(st.envNamesLocked(viperPath), " or ")
+}
+
+func (st *viperState) envNamesLocked(viperPath string) []string {
+	name := strings.ReplaceAll(viperPath, ".", st.separator())
+	if st.envPrefix != "" {
+		name = st.envPrefix + "_" + name
+	}
+	return append([]string{strings.ToUpper(name)}, st.envBindings[viperPath].names(st.separator())...)
+}
+
+// boundEnvNames are the names of the env vars of all the bound keys
+func (st *viperState) boundEnvNames() map[string]bool {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	names := map[string]bool{}
+	for _, k := range st.boundKeys {
+		for _, name := range st.envNamesLocked(k) {
+			names[name] = true
+		}
+	}
+	for k := range st.envBindings {
+		for _, name := range st.envNamesLocked(k) {
+			names[name] = true
+		}
+	}
+	return names
+}
+
+func (st *viperState) bind(keys []string) error {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	for _, k := range keys {
+		st.boundKeys = append(st.boundKeys, strings.ToLower(k))
+	}
+	return st.checkDefaults()
+}
+
+// setTagDefault sets `tag` as the default of `viperPath` in viper, beneath the embedded defaults,
+// so it's skipped for keys that are in them.
+func (st *viperState) setTagDefault(v *viper.Viper, viperPath, tag string) {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	inDefaults := slices.ContainsFunc(st.defaultKeys, func(dk string) bool {
+		return dk == viperPath || strings.HasPrefix(dk, viperPath+".") || strings.HasPrefix(viperPath, dk+".")
+	})
+	if !inDefaults {
+		v.SetDefault(viperPath, tag)
+	}
+}
+
+// checkDefaults verifies that every key in the embedded defaults exists in the bound struct.
+// It does nothing until both the defaults and the struct are known.
+func (st *viperState) checkDefaults() error {
+	if len(st.defaultKeys) == 0 || len(st.boundKeys) == 0 {
+		return nil
+	}
+	var errs []error
+	for _, dk := range st.defaultKeys {
+		known := slices.ContainsFunc(st.boundKeys, func(bk string) bool {
+			return dk == bk || strings.HasPrefix(dk, bk+".") || strings.HasPrefix(bk, dk+".")
+		})
+		if !known {
+			errs = append(errs, fmt.Errorf("default key %q does not exist in the bound struct", dk))
+		}
+	}
+	return errors.Join(errs...)
+}
+
 type viperFlagAdapter struct {
 	pf        *pflag.Flag
 	viperPath string
@@ -75,10 +427,15 @@ func (f viperFlagAdapter) Name() string {
 type viperFlagsAdapter struct {
 	pfs            *pflag.FlagSet
 	vipathByPFName map[string]string
+	// skip are flags that factor3 reads itself, e.g of elements of slices
+	skip map[string]bool
 }
 
 func (fs viperFlagsAdapter) VisitAll(fn func(viper.FlagValue)) {
 	fs.pfs.VisitAll(func(pf *pflag.Flag) {
+		if fs.skip[pf.Name] {
+			return
+		}
 		fn(viperFlagAdapter{pf: pf, viperPath: fs.vipathByPFName[pf.Name]})
 	})
 }
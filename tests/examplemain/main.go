@@ -34,7 +34,7 @@ var (
 )
 
 func init() {
-	viperInstance := viper.New()
+	viperInstance := factor3.NewViper(viper.New())
 	err := factor3.InitializeViper(factor3.InitArgs{
 		Viper:       viperInstance,
 		ProgramName: "myprogram",